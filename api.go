@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// APITokenEnv is the environment variable with the token clients of
+// the API have to send as `Authorization: Bearer <token>`, if it is set.
+const APITokenEnv = "S3PUT_API_TOKEN"
+
+// JobStatus is the state of a job as returned by the API.
+type JobStatus struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	Running  bool   `json:"running"`
+	// Started and Progress are set while the job is running.
+	Started  *time.Time       `json:"started,omitempty"`
+	Progress *storage.Summary `json:"progress,omitempty"`
+	NextRun  *time.Time       `json:"next_run,omitempty"`
+	LastRun  *JobRun          `json:"last_run,omitempty"`
+}
+
+// Status returns the state of job.
+func (job *Job) Status() JobStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	status := JobStatus{
+		Name:     job.Name,
+		Schedule: job.Schedule.String(),
+		Running:  job.running,
+		LastRun:  job.last,
+	}
+	if job.running {
+		started := job.started
+		status.Started = &started
+		if job.progressFile != "" {
+			status.Progress = readSummary(job.progressFile)
+		}
+	}
+	if !job.next.IsZero() {
+		next := job.next
+		status.NextRun = &next
+	}
+	return status
+}
+
+// ServeAPI serves an API to control the daemon at addr:
+//
+//	GET  /jobs             the state of all jobs
+//	GET  /jobs/<name>      the state of a job
+//	POST /jobs/<name>/run  run a job now
+//
+// Without a token in $S3PUT_API_TOKEN, only loopback addresses are
+// served, as anyone who can reach the API can run the jobs.
+func (d *Daemon) ServeAPI(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	token := os.Getenv(APITokenEnv)
+	if tcpAddr, ok := l.Addr().(*net.TCPAddr); token == "" && (!ok || !tcpAddr.IP.IsLoopback()) {
+		l.Close()
+		return fmt.Errorf("%s is reachable from other hosts, set $%s to require a token", addr, APITokenEnv)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", d.serveJobs)
+	mux.HandleFunc("/jobs/", d.serveJob)
+	go http.Serve(l, requireToken(token, mux))
+	return nil
+}
+
+func (d *Daemon) serveJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		apiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	jobs := []JobStatus{}
+	for _, job := range d.Jobs {
+		jobs = append(jobs, job.Status())
+	}
+	apiResponse(w, http.StatusOK, jobs)
+}
+
+func (d *Daemon) serveJob(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	job := d.Job(path[0])
+	if job == nil || len(path) > 2 || (len(path) == 2 && path[1] != "run") {
+		apiError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	switch {
+	case len(path) == 1 && r.Method == "GET":
+		apiResponse(w, http.StatusOK, job.Status())
+	case len(path) == 2 && r.Method == "POST":
+		err := d.Trigger(job)
+		switch {
+		case err == errJobRunning:
+			apiError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			apiError(w, http.StatusServiceUnavailable, err.Error())
+		default:
+			apiResponse(w, http.StatusAccepted, job.Status())
+		}
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// requireToken only passes on requests carrying token, if it is set.
+func requireToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			apiError(w, http.StatusUnauthorized, "Invalid or missing token")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func apiResponse(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	apiResponse(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestServeAPIRequiresTokenForOtherHosts(t *testing.T) {
+	os.Unsetenv(APITokenEnv)
+	d := &Daemon{}
+	if err := d.ServeAPI(":0"); err == nil {
+		t.Error("Served the API on all interfaces without a token")
+	}
+	if err := d.ServeAPI("127.0.0.1:0"); err != nil {
+		t.Errorf("Could not serve the API on localhost: %s", err)
+	}
+	os.Setenv(APITokenEnv, "secret")
+	defer os.Unsetenv(APITokenEnv)
+	if err := d.ServeAPI(":0"); err != nil {
+		t.Errorf("Could not serve the API with a token: %s", err)
+	}
+}
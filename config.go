@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/surma/s3put/storage"
+)
+
+// ConfigFileName is the name of the config file in the home directory.
+const ConfigFileName = ".s3put.toml"
+
+// Remote is a named storage defined in the config file, so that
+// `s3put put prod:assets ./dist` can replace a list of flags.
+type Remote struct {
+	Bucket      string
+	Endpoint    string
+	Region      string
+	Prefix      string
+	Profile     string
+	Credentials string
+	RoleArn     string
+	Concurrency int
+
+	// Defaults for uploads, so that the deployment
+	// policy of a bucket is defined in one place.
+	CacheControl      string
+	CacheControlRules []string
+	ACL               string
+	StorageClass      string
+	Include           []string
+	Exclude           []string
+}
+
+// Config is the content of the config file:
+//
+//	[remotes.prod]
+//	bucket = "s3://s3-eu-west-1.amazonaws.com/example"
+//	prefix = "www"
+//	profile = "deploy"
+//	concurrency = 20
+//	cache_control_rules = ["*.html=no-cache", "*=max-age=31536000"]
+//	exclude = ["*.map"]
+//
+//	[jobs.backup]
+//	schedule = "30 2 * * *"
+//	args = ["--continue", "put", "prod:backup", "/srv/data"]
+//	log = "/var/log/s3put/backup.log"
+type Config struct {
+	Remotes map[string]*Remote
+	// Jobs are run by `s3put daemon`.
+	Jobs map[string]*Job
+}
+
+// LoadConfig reads the config file at path. If path is empty, the
+// file in the home directory is read if it exists.
+func LoadConfig(path string) (*Config, error) {
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &Config{}, nil
+		}
+		path = filepath.Join(home, ConfigFileName)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return &Config{}, nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	tables, err := parseTOML(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	config := &Config{Remotes: map[string]*Remote{}, Jobs: map[string]*Job{}}
+	for table, values := range tables {
+		if table == "" {
+			for key := range values {
+				return nil, fmt.Errorf("%s: Unknown key %s outside of a remote", path, key)
+			}
+			continue
+		}
+		if strings.HasPrefix(table, "jobs.") {
+			job, err := parseJob(strings.TrimPrefix(table, "jobs."), values)
+			if err != nil {
+				return nil, fmt.Errorf("%s: [%s] %s", path, table, err)
+			}
+			config.Jobs[job.Name] = job
+			continue
+		}
+		if !strings.HasPrefix(table, "remotes.") {
+			return nil, fmt.Errorf("%s: Unknown table [%s]", path, table)
+		}
+		name := strings.TrimPrefix(table, "remotes.")
+		remote := &Remote{}
+		for key, value := range values {
+			var err error
+			switch key {
+			case "bucket":
+				err = tomlString(value, &remote.Bucket)
+			case "endpoint":
+				err = tomlString(value, &remote.Endpoint)
+			case "region":
+				err = tomlString(value, &remote.Region)
+			case "prefix":
+				err = tomlString(value, &remote.Prefix)
+			case "profile":
+				err = tomlString(value, &remote.Profile)
+			case "credentials":
+				err = tomlString(value, &remote.Credentials)
+			case "role_arn":
+				err = tomlString(value, &remote.RoleArn)
+			case "concurrency":
+				err = tomlInt(value, &remote.Concurrency)
+			case "cache_control":
+				err = tomlString(value, &remote.CacheControl)
+			case "cache_control_rules":
+				err = tomlStrings(value, &remote.CacheControlRules)
+			case "acl":
+				err = tomlString(value, &remote.ACL)
+			case "storage_class":
+				err = tomlString(value, &remote.StorageClass)
+			case "include":
+				err = tomlStrings(value, &remote.Include)
+			case "exclude":
+				err = tomlStrings(value, &remote.Exclude)
+			default:
+				err = errors.New("Unknown key")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: [%s] %s: %s", path, table, key, err)
+			}
+		}
+		if remote.Bucket == "" {
+			return nil, fmt.Errorf("%s: [%s] has no bucket", path, table)
+		}
+		config.Remotes[name] = remote
+	}
+	return config, nil
+}
+
+func parseJob(name string, values map[string]interface{}) (*Job, error) {
+	job := &Job{Name: name}
+	var schedule string
+	for key, value := range values {
+		var err error
+		switch key {
+		case "schedule":
+			err = tomlString(value, &schedule)
+			if err == nil {
+				job.Schedule, err = ParseSchedule(schedule)
+			}
+		case "args":
+			err = tomlStrings(value, &job.Args)
+		case "log":
+			err = tomlString(value, &job.Log)
+		default:
+			err = errors.New("Unknown key")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	if job.Schedule == nil {
+		return nil, errors.New("Has no schedule")
+	}
+	if len(job.Args) == 0 {
+		return nil, errors.New("Has no args")
+	}
+	return job, nil
+}
+
+// ParseRemote splits a reference like `prod:assets` into the remote
+// and the path below its prefix. ok is false if arg doesn't refer to
+// one of the configured remotes.
+func (c *Config) ParseRemote(arg string) (remote *Remote, p string, ok bool) {
+	i := strings.Index(arg, ":")
+	if i <= 0 {
+		return nil, "", false
+	}
+	remote, ok = c.Remotes[arg[:i]]
+	return remote, strings.Trim(path.Clean("/"+arg[i+1:]), "/"), ok
+}
+
+func tomlString(value interface{}, s *string) error {
+	v, ok := value.(string)
+	if !ok {
+		return errors.New("Must be a string")
+	}
+	*s = v
+	return nil
+}
+
+func tomlStrings(value interface{}, s *[]string) error {
+	v, ok := value.([]string)
+	if !ok {
+		return errors.New("Must be an array of strings")
+	}
+	*s = v
+	return nil
+}
+
+func tomlInt(value interface{}, n *int) error {
+	v, ok := value.(int64)
+	if !ok {
+		return errors.New("Must be an integer")
+	}
+	*n = int(v)
+	return nil
+}
+
+// parseTOML parses the subset of TOML used by the config file: Tables,
+// strings, integers, booleans and arrays of strings. Keys before the
+// first table are in the table "".
+func parseTOML(f *os.File) (map[string]map[string]interface{}, error) {
+	tables := map[string]map[string]interface{}{"": {}}
+	table := ""
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("Line %d: Invalid table header", lineno)
+			}
+			table = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := tables[table]; ok {
+				return nil, fmt.Errorf("Line %d: Table [%s] defined twice", lineno, table)
+			}
+			tables[table] = map[string]interface{}{}
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Line %d: Expected key = value", lineno)
+		}
+		key := strings.TrimSpace(line[:i])
+		raw := strings.TrimSpace(line[i+1:])
+		// Arrays may span lines.
+		for strings.HasPrefix(raw, "[") && !strings.HasSuffix(raw, "]") && scanner.Scan() {
+			lineno++
+			raw += " " + strings.TrimSpace(stripTOMLComment(scanner.Text()))
+		}
+		value, err := parseTOMLValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", lineno, err)
+		}
+		tables[table][key] = value
+	}
+	return tables, scanner.Err()
+}
+
+// stripTOMLComment removes a comment from line, ignoring `#` in strings.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == 0 && c == '#':
+			return line[:i]
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(raw string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return nil, fmt.Errorf("Invalid string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case raw == "true" || raw == "false":
+		return raw == "true", nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, errors.New("Unterminated array")
+		}
+		var values []string
+		for _, elem := range splitTOMLArray(raw[1 : len(raw)-1]) {
+			v, err := parseTOMLValue(elem)
+			if err != nil {
+				return nil, err
+			}
+			s, ok := v.(string)
+			if !ok {
+				return nil, errors.New("Only arrays of strings are supported")
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	}
+	n, err := strconv.ParseInt(strings.Replace(raw, "_", "", -1), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value %s", raw)
+	}
+	return n, nil
+}
+
+// splitTOMLArray splits the content of an array at the commas
+// between its elements.
+func splitTOMLArray(s string) []string {
+	var elems []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == 0 && c == ',':
+			elems = append(elems, s[start:i])
+			start = i + 1
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == '"' && c == '\\':
+			i++
+		case c == quote:
+			quote = 0
+		}
+	}
+	elems = append(elems, s[start:])
+	var result []string
+	for _, elem := range elems {
+		// Arrays may end with a comma.
+		if elem = strings.TrimSpace(elem); elem != "" {
+			result = append(result, elem)
+		}
+	}
+	return result
+}
+
+// Filter returns the rules for the remote's include and exclude
+// patterns. Includes come first, so they can make exceptions
+// to excludes.
+func (r *Remote) Filter() storage.Filter {
+	var f storage.Filter
+	for _, pattern := range r.Include {
+		f = append(f, storage.FilterRule{Include: true, Pattern: pattern})
+	}
+	for _, pattern := range r.Exclude {
+		f = append(f, storage.FilterRule{Include: false, Pattern: pattern})
+	}
+	return f
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "s3put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, ConfigFileName)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+# Deployment targets
+[remotes.prod]
+bucket = "s3://s3-eu-west-1.amazonaws.com/example" # the live site
+prefix = 'www#1'
+concurrency = 1_000
+cache_control_rules = [
+	"*.html=no-cache",  # always revalidate
+	"*=max-age=31536000",
+]
+exclude = ["*.map", "a,b", "say \"hi\""]
+
+[jobs.backup]
+schedule = "30 2 * * *"
+args = ["--continue", "put", "prod:backup", "/srv/data"]
+`)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Remote{
+		Bucket:            "s3://s3-eu-west-1.amazonaws.com/example",
+		Prefix:            "www#1",
+		Concurrency:       1000,
+		CacheControlRules: []string{"*.html=no-cache", "*=max-age=31536000"},
+		Exclude:           []string{"*.map", "a,b", `say "hi"`},
+	}
+	if got := config.Remotes["prod"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got remote %+v, want %+v", got, want)
+	}
+	job := config.Jobs["backup"]
+	if job == nil {
+		t.Fatal("Job backup is missing")
+	}
+	if job.Schedule.String() != "30 2 * * *" || len(job.Args) != 4 {
+		t.Errorf("Got job %+v", job)
+	}
+
+	remote, p, ok := config.ParseRemote("prod:assets/../img/")
+	if !ok || remote != config.Remotes["prod"] || p != "img" {
+		t.Errorf("ParseRemote = %v, %q, %v", remote, p, ok)
+	}
+	if _, _, ok := config.ParseRemote("staging:assets"); ok {
+		t.Error("ParseRemote accepted an unknown remote")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"bucket = \"x\"\n", "Unknown key bucket outside of a remote"},
+		{"[remotes.a]\nbucket = \"x\"\n[remotes.a]\n", "Line 3: Table [remotes.a] defined twice"},
+		{"[remotes.a]\nprefix = \"x\"\n", "[remotes.a] has no bucket"},
+		{"[remotes.a]\nbucket = \"x\"\ncolour = \"red\"\n", "colour: Unknown key"},
+		{"[remotes.a]\nbucket = 1\n", "bucket: Must be a string"},
+		{"[remotes.a]\nconcurrency = ten\n", "Line 2: Invalid value ten"},
+		{"[remotes.a\n", "Line 1: Invalid table header"},
+		{"[servers.a]\n", "Unknown table [servers.a]"},
+		{"[jobs.a]\nargs = [\"put\"]\n", "Has no schedule"},
+		{"[jobs.a]\nschedule = \"61 * * * *\"\nargs = [\"put\"]\n", "schedule: Invalid field 61"},
+	}
+	for _, test := range tests {
+		_, err := LoadConfig(writeConfig(t, test.content))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %s", test.content, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// Job is a transfer that `s3put daemon` runs on a schedule.
+type Job struct {
+	Name     string
+	Schedule *Schedule
+	// Args is the command line of the transfer,
+	// e.g. ["put", "prod:assets", "/srv/assets"].
+	Args []string
+	// Log is the file the output of the job is appended to. By
+	// default, it goes to the log of the daemon, prefixed with the
+	// name of the job.
+	Log string
+
+	mu      sync.Mutex
+	running bool
+	started time.Time
+	// progressFile is where the running process
+	// writes its progress.
+	progressFile string
+	next         time.Time
+	last         *JobRun
+}
+
+// JobRun is the outcome of a run of a job.
+type JobRun struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	ExitCode int       `json:"exit_code"`
+	// Status is ok, failed, aborted or invalid options.
+	Status string `json:"status"`
+	// Summary is missing if the job failed before transferring.
+	Summary *storage.Summary `json:"summary,omitempty"`
+}
+
+// Daemon runs jobs on their schedules. Every run is a separate
+// s3put process, so jobs can use all options and don't share any
+// state. A job is not started again while it is still running, so
+// runs that would overlap with the previous one are skipped.
+type Daemon struct {
+	// Jobs are sorted by name.
+	Jobs []*Job
+	// Executable is the s3put binary to run jobs with,
+	// Args are added to the arguments of all jobs.
+	Executable string
+	Args       []string
+
+	abort, stop context.Context
+	wg          sync.WaitGroup
+}
+
+// NewDaemon returns a daemon running jobs until stop is cancelled.
+// Running jobs are interrupted then, and once more when abort is
+// cancelled.
+func NewDaemon(abort, stop context.Context, jobs map[string]*Job, args []string) (*Daemon, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	d := &Daemon{Executable: executable, Args: args, abort: abort, stop: stop}
+	for _, job := range jobs {
+		d.Jobs = append(d.Jobs, job)
+	}
+	sort.Slice(d.Jobs, func(i, j int) bool { return d.Jobs[i].Name < d.Jobs[j].Name })
+	return d, nil
+}
+
+// Run schedules the jobs until the daemon is stopped and returns
+// when all jobs have ended.
+func (d *Daemon) Run() {
+	for _, job := range d.Jobs {
+		d.wg.Add(1)
+		go func(job *Job) {
+			defer d.wg.Done()
+			d.schedule(job)
+		}(job)
+	}
+	d.wg.Wait()
+}
+
+// Job returns the job called name, or nil if there is none.
+func (d *Daemon) Job(name string) *Job {
+	for _, job := range d.Jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// Trigger starts a run of job now, outside of its schedule.
+func (d *Daemon) Trigger(job *Job) error {
+	if d.stop.Err() != nil {
+		return errors.New("Daemon is stopping")
+	}
+	if !job.claim() {
+		return errJobRunning
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		if err := d.run(job); err != nil {
+			log.Printf("Could not run job %s: %s", job.Name, err)
+		}
+	}()
+	return nil
+}
+
+var errJobRunning = errors.New("Job is still running")
+
+// claim marks job as running unless it already is.
+func (job *Job) claim() bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.running {
+		return false
+	}
+	job.running = true
+	job.started = time.Now()
+	return true
+}
+
+func (d *Daemon) schedule(job *Job) {
+	for {
+		next := job.Schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Job %s never runs, its schedule %s matches no date", job.Name, job.Schedule)
+			return
+		}
+		job.mu.Lock()
+		job.next = next
+		job.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-d.stop.Done():
+			timer.Stop()
+			return
+		}
+		if !job.claim() {
+			infof("Skipping job %s, it is still running", job.Name)
+			continue
+		}
+		if err := d.run(job); err != nil {
+			log.Printf("Could not run job %s: %s", job.Name, err)
+		}
+	}
+}
+
+// run runs the claimed job and waits for it to end.
+func (d *Daemon) run(job *Job) error {
+	defer func() {
+		job.mu.Lock()
+		job.running = false
+		job.progressFile = ""
+		job.mu.Unlock()
+	}()
+
+	var out io.Writer = &prefixWriter{prefix: job.Name + ": ", w: log.Writer()}
+	if job.Log != "" {
+		lf, err := OpenLogFile(job.Log)
+		if err != nil {
+			return err
+		}
+		defer lf.Close()
+		out = lf
+	}
+	summaryFile, err := tempPath("s3put-summary")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(summaryFile)
+	progressFile, err := tempPath("s3put-progress")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(progressFile)
+	defer os.Remove(progressFile + ".tmp")
+	// Global options must come before the verb.
+	args := append(append([]string{}, d.Args...), "--summary-json", summaryFile)
+	cmd := exec.Command(d.Executable, append(args, job.Args...)...)
+	cmd.Env = append(os.Environ(), ProgressFileEnv+"="+progressFile)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	detachJob(cmd)
+	job.mu.Lock()
+	job.progressFile = progressFile
+	job.mu.Unlock()
+
+	infof("Starting job %s", job.Name)
+	run := &JobRun{Start: time.Now()}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-d.stop.Done():
+			interruptJob(cmd, false)
+		case <-done:
+			return
+		}
+		select {
+		case <-d.abort.Done():
+			interruptJob(cmd, true)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if p, ok := out.(*prefixWriter); ok {
+		p.Flush()
+	}
+	run.End = time.Now()
+	run.ExitCode = ExitOK
+	if err != nil {
+		run.ExitCode = ExitError
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			run.ExitCode = exitErr.ExitCode()
+		}
+	}
+	run.Status = jobStatus(run.ExitCode)
+	run.Summary = readSummary(summaryFile)
+	job.mu.Lock()
+	job.last = run
+	job.mu.Unlock()
+	if run.ExitCode == ExitOK {
+		infof("Job %s finished: %s", job.Name, run)
+	} else {
+		log.Printf("Job %s failed: %s", job.Name, run)
+	}
+	return nil
+}
+
+func jobStatus(code int) string {
+	switch code {
+	case ExitOK:
+		return "ok"
+	case ExitConfig:
+		return "invalid options"
+	case ExitAborted:
+		return "aborted"
+	default:
+		return "failed"
+	}
+}
+
+// tempPath returns the path of a new, empty temporary file.
+func tempPath(prefix string) (string, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return f.Name(), nil
+}
+
+// readSummary reads a summary written by WriteSummary,
+// returning nil if there is none (yet).
+func readSummary(path string) *storage.Summary {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var summary storage.Summary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		return nil
+	}
+	return &summary
+}
+
+// String describes the outcome of the run.
+func (r *JobRun) String() string {
+	s := r.Status
+	if r.Status == "failed" && r.ExitCode != ExitPartial {
+		s = fmt.Sprintf("failed with exit code %d", r.ExitCode)
+	}
+	if r.Summary != nil {
+		stats := storage.TransferStats{
+			Transferred: r.Summary.Transferred,
+			Skipped:     r.Summary.Skipped,
+			Failed:      r.Summary.Failed,
+			Cancelled:   r.Summary.NotStarted,
+		}
+		s += fmt.Sprintf(", %s", stats)
+	}
+	return fmt.Sprintf("%s (%s)", s, r.End.Sub(r.Start).Round(time.Second))
+}
+
+// PrintStatus prints the state of all jobs to w.
+func (d *Daemon) PrintStatus(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "JOB\tSCHEDULE\tLAST RUN\tNEXT RUN\n")
+	for _, job := range d.Jobs {
+		job.mu.Lock()
+		last := "never"
+		switch {
+		case job.running:
+			last = "running since " + job.started.Format("2006-01-02 15:04:05")
+		case job.last != nil:
+			last = job.last.Start.Format("2006-01-02 15:04:05") + ", " + job.last.String()
+		}
+		next := "-"
+		if !job.next.IsZero() {
+			next = job.next.Format("2006-01-02 15:04")
+		}
+		job.mu.Unlock()
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", job.Name, job.Schedule, last, next)
+	}
+	tw.Flush()
+}
+
+// prefixWriter writes lines to w, prefixed with prefix.
+type prefixWriter struct {
+	prefix string
+	w      io.Writer
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if _, err := io.WriteString(p.w, p.prefix+string(p.buf[:i+1])); err != nil {
+			return len(b), err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes an incomplete last line.
+func (p *prefixWriter) Flush() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.buf) > 0 {
+		io.WriteString(p.w, p.prefix+string(p.buf)+"\n")
+		p.buf = nil
+	}
+}
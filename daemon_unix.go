@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detachJob puts the process of a job into its own process group, so
+// that a Ctrl-C in the terminal only reaches the daemon, which passes
+// it on with interruptJob.
+func detachJob(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// interruptJob interrupts a job like Ctrl-C does. The first interrupt
+// makes it finish the running transfers, the second (abort) aborts them.
+func interruptJob(cmd *exec.Cmd, abort bool) {
+	cmd.Process.Signal(os.Interrupt)
+}
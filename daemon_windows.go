@@ -0,0 +1,15 @@
+package main
+
+import "os/exec"
+
+// detachJob does nothing, as the processes of jobs get the
+// Ctrl-C of the console anyway.
+func detachJob(cmd *exec.Cmd) {}
+
+// interruptJob kills the job on abort, as processes can't be
+// interrupted on Windows.
+func interruptJob(cmd *exec.Cmd, abort bool) {
+	if abort {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"os"
+)
+
+// Exit codes, so that scripts can tell how a run went.
+const (
+	// ExitOK means that all files have been transferred.
+	ExitOK = 0
+	// ExitError is used for errors that have no code of their own,
+	// e.g. if a bucket can't be listed.
+	ExitError = 1
+	// ExitPartial means that some files could not be transferred,
+	// all others have been (with --continue or --max-errors).
+	ExitPartial = 2
+	// ExitConfig means invalid options, an invalid config
+	// file or missing or invalid credentials.
+	ExitConfig = 3
+	// ExitAborted means that the run was interrupted or aborted
+	// because files failed (see --max-errors).
+	ExitAborted = 4
+	// ExitDifferent means that `check` found missing, extra or
+	// mismatching files.
+	ExitDifferent = 5
+)
+
+// exitf logs the message like log.Fatalf, but exits with code.
+func exitf(code int, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	os.Exit(code)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadFileList reads a list of paths from the file at path (or stdin
+// if path is `-`), one path per line or, if nulSeparated is set,
+// separated by NUL bytes.
+func ReadFileList(path string, nulSeparated bool) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	scanner := bufio.NewScanner(r)
+	if nulSeparated {
+		scanner.Split(scanNul)
+	}
+	var paths []string
+	for scanner.Scan() {
+		p := strings.TrimRight(scanner.Text(), "\r")
+		if p == "" {
+			continue
+		}
+		p = strings.TrimPrefix(filepath.Clean(p), string(filepath.Separator))
+		paths = append(paths, p)
+	}
+	return paths, scanner.Err()
+}
+
+func scanNul(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// Hooks are commands run after transfers, e.g. to invalidate the
+// cache of a CDN or for bookkeeping. They get the details of the run
+// and the file in environment variables:
+//
+//	S3PUT_VERB, S3PUT_BUCKET, S3PUT_PREFIX, S3PUT_LOCAL  the run
+//	S3PUT_KEY, S3PUT_SIZE, S3PUT_DURATION, S3PUT_ERROR   the file
+//
+// The command of the whole run gets S3PUT_STATUS (success, failed or
+// interrupted), S3PUT_TRANSFERRED, S3PUT_SKIPPED, S3PUT_FAILED,
+// S3PUT_NOT_STARTED, S3PUT_BYTES and S3PUT_DURATION instead.
+type Hooks struct {
+	// OnComplete is run after each file that has been transferred.
+	OnComplete string
+	// OnError is run after each file that failed.
+	OnError string
+	// OnFinish is run after the whole run.
+	OnFinish string
+	// Env describes the run.
+	Env []string
+}
+
+// Transfer runs the hook for the outcome of the transfer of item,
+// which took d.
+func (h *Hooks) Transfer(item *storage.Item, skipped bool, err error, d time.Duration) {
+	command := h.OnComplete
+	if err != nil {
+		command = h.OnError
+	}
+	if command == "" || skipped {
+		return
+	}
+	env := []string{
+		"S3PUT_KEY=" + item.Key(),
+		"S3PUT_SIZE=" + strconv.FormatInt(item.Size, 10),
+		"S3PUT_DURATION=" + formatSeconds(d),
+	}
+	if err != nil {
+		env = append(env, "S3PUT_ERROR="+err.Error())
+	}
+	if err := h.run(command, env); err != nil {
+		log.Printf("Hook for %s failed: %s", item, err)
+	}
+}
+
+// Finish runs the hook for the end of the run.
+func (h *Hooks) Finish(stats storage.TransferStats, transferred int64, d time.Duration, interrupted bool) {
+	if h.OnFinish == "" {
+		return
+	}
+	status := "success"
+	switch {
+	case interrupted:
+		status = "interrupted"
+	case stats.Failed > 0:
+		status = "failed"
+	}
+	err := h.run(h.OnFinish, []string{
+		"S3PUT_STATUS=" + status,
+		"S3PUT_TRANSFERRED=" + strconv.FormatInt(stats.Transferred, 10),
+		"S3PUT_SKIPPED=" + strconv.FormatInt(stats.Skipped, 10),
+		"S3PUT_FAILED=" + strconv.FormatInt(stats.Failed, 10),
+		"S3PUT_NOT_STARTED=" + strconv.FormatInt(stats.Cancelled, 10),
+		"S3PUT_BYTES=" + strconv.FormatInt(transferred, 10),
+		"S3PUT_DURATION=" + formatSeconds(d),
+	})
+	if err != nil {
+		log.Printf("Hook for the end of the run failed: %s", err)
+	}
+}
+
+// run runs command in the shell. Its output goes to stderr, as
+// stdout may be taken by --summary-json.
+func (h *Hooks) run(command string, env []string) error {
+	cmd := storage.ShellCommand(command)
+	cmd.Env = append(append(os.Environ(), h.Env...), env...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func formatSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
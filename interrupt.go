@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptContexts returns the contexts of a transfer run: stop is
+// cancelled on the first SIGINT or SIGTERM, so that no new transfers
+// are started, abort on the second one to abort the running ones.
+func interruptContexts() (abort, stop context.Context) {
+	abort, cancelAbort := context.WithCancel(context.Background())
+	stop, cancelStop := context.WithCancel(abort)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		infof("Finishing running transfers, interrupt again to abort them...")
+		cancelStop()
+		<-signals
+		infof("Aborting transfers...")
+		cancelAbort()
+		signal.Stop(signals)
+	}()
+	return abort, stop
+}
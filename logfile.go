@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"sync"
+)
+
+// LogFile appends log messages to a file. If the file is moved away
+// or deleted (e.g. by logrotate), it is created again, so that logs
+// can be rotated without telling s3put.
+type LogFile struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	l := &LogFile{path: path}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *LogFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	return nil
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rotated() {
+		l.f.Close()
+		if err := l.open(); err != nil {
+			return 0, err
+		}
+	}
+	return l.f.Write(p)
+}
+
+// rotated reports whether the file at the path isn't the open one anymore.
+func (l *LogFile) rotated() bool {
+	current, err := l.f.Stat()
+	if err != nil {
+		return true
+	}
+	fi, err := os.Stat(l.path)
+	return err != nil || !os.SameFile(current, fi)
+}
+
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
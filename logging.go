@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// logLevel is how much s3put logs, chosen with -q and -v.
+var logLevel = storage.LogInfo
+
+// jsonLog is set by `--log-format json`, which turns the log into
+// a stream of JSON objects, one per line, for log pipelines.
+var jsonLog bool
+
+// Syslogger sends messages to the system log with a priority.
+type Syslogger interface {
+	Err(m string) error
+	Info(m string) error
+	Debug(m string) error
+}
+
+// sysLog is set by --log-syslog. Messages of a known level are sent to
+// it directly, everything else is logged as an error via SyslogWriter.
+var sysLog Syslogger
+
+func infof(format string, args ...interface{}) {
+	if logLevel >= storage.LogInfo {
+		output(storage.LogInfo, fmt.Sprintf(format, args...))
+	}
+}
+
+func verbosef(format string, args ...interface{}) {
+	if logLevel >= storage.LogVerbose {
+		output(storage.LogVerbose, fmt.Sprintf(format, args...))
+	}
+}
+
+func debugf(format string, args ...interface{}) {
+	if logLevel >= storage.LogDebug {
+		output(storage.LogDebug, fmt.Sprintf(format, args...))
+	}
+}
+
+// output logs msg, which is of the given level (storage.LogQuiet for errors).
+func output(level storage.LogLevel, msg string) {
+	if sysLog == nil {
+		log.Print(msg)
+		return
+	}
+	if jsonLog && !strings.HasPrefix(msg, "{") {
+		msg = string(jsonMessage(msg))
+	}
+	switch level {
+	case storage.LogQuiet:
+		sysLog.Err(msg)
+	case storage.LogInfo, storage.LogVerbose:
+		sysLog.Info(msg)
+	default:
+		sysLog.Debug(msg)
+	}
+}
+
+// SyslogWriter logs messages written to it as errors.
+type SyslogWriter struct {
+	Syslogger
+}
+
+func (w SyslogWriter) Write(p []byte) (int, error) {
+	return len(p), w.Err(strings.TrimSuffix(string(p), "\n"))
+}
+
+// LoggingRoundTripper logs every request with the response's status
+// and how long it took.
+type LoggingRoundTripper struct {
+	http.RoundTripper
+}
+
+func (lrt *LoggingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := lrt.RoundTripper.RoundTrip(r)
+	// Don't log signatures in the query of presigned requests.
+	u := *r.URL
+	u.RawQuery = ""
+	if err != nil {
+		debugf("%s %s: %s (%s)", r.Method, u.String(), err, time.Since(start).Round(time.Millisecond))
+		return nil, err
+	}
+	debugf("%s %s: %s (%s)", r.Method, u.String(), resp.Status, time.Since(start).Round(time.Millisecond))
+	return resp, err
+}
+
+// logEvent logs an event of a transfer run in the JSON log. Events
+// are `start`, `transfer` (done or skipped), `error` and `summary`.
+func logEvent(event string, fields map[string]interface{}) {
+	fields["event"] = event
+	fields["time"] = time.Now().Format(time.RFC3339Nano)
+	data, err := json.Marshal(fields)
+	if err != nil {
+		log.Printf("Could not encode %s event: %s", event, err)
+		return
+	}
+	level := storage.LogInfo
+	if event == "error" {
+		level = storage.LogQuiet
+	}
+	output(level, string(data))
+}
+
+// logTransfer logs the outcome of the transfer of item, which took d.
+func logTransfer(item *storage.Item, skipped bool, err error, d time.Duration) {
+	if !jsonLog {
+		switch {
+		case err != nil:
+			log.Printf("Could not transfer %s: %s", item, err)
+		case !logTransfers:
+		case skipped:
+			infof("Skipped %s, already exists", item)
+		default:
+			infof("Transfer of %s done", item)
+		}
+		return
+	}
+	fields := map[string]interface{}{
+		"key":      item.Key(),
+		"size":     item.Size,
+		"duration": d.Seconds(),
+	}
+	switch {
+	case err != nil:
+		fields["error"] = err.Error()
+		logEvent("error", fields)
+	case logLevel >= storage.LogInfo:
+		fields["skipped"] = skipped
+		logEvent("transfer", fields)
+	}
+}
+
+// logSummary logs what happened to all items.
+func logSummary(stats storage.TransferStats, bytes int64, d time.Duration) {
+	if !jsonLog {
+		infof("Summary: %s", stats)
+		return
+	}
+	if logLevel >= storage.LogInfo {
+		logEvent("summary", map[string]interface{}{
+			"transferred": stats.Transferred,
+			"skipped":     stats.Skipped,
+			"failed":      stats.Failed,
+			"not_started": stats.Cancelled,
+			"bytes":       bytes,
+			"duration":    d.Seconds(),
+		})
+	}
+}
+
+// JSONLogWriter turns log messages into JSON objects like
+//
+//	{"event":"message","message":"Could not open x: ...","time":"..."}
+//
+// Events logged with logEvent are already JSON and passed through.
+type JSONLogWriter struct {
+	io.Writer
+}
+
+func (w *JSONLogWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 && p[0] == '{' {
+		return w.Writer.Write(p)
+	}
+	_, err := w.Writer.Write(append(jsonMessage(strings.TrimSuffix(string(p), "\n")), '\n'))
+	return len(p), err
+}
+
+// jsonMessage encodes msg as a message event.
+func jsonMessage(msg string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"event":   "message",
+		"message": msg,
+		"time":    time.Now().Format(time.RFC3339Nano),
+	})
+	return data
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// latencyBuckets are the upper bounds of the buckets
+// of the request latency histogram in seconds.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics serves the state of the transfers in the Prometheus text
+// format, so that long-running transfers can be graphed and alerted on.
+type Metrics struct {
+	mu       sync.Mutex
+	progress *storage.Progress
+	workers  int
+	// Request latencies by HTTP method.
+	requests map[string]*histogram
+}
+
+type histogram struct {
+	// counts holds the number of observations per bucket,
+	// the last one is for those above all bounds.
+	counts []int64
+	sum    float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{requests: map[string]*histogram{}}
+}
+
+// Serve serves the metrics of the transfers tracked by progress
+// at http://addr/metrics in the background.
+func (m *Metrics) Serve(addr string, progress *storage.Progress, workers int) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.progress, m.workers = progress, workers
+	m.mu.Unlock()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go http.Serve(l, mux)
+	return nil
+}
+
+// observe records a request with method that took d.
+func (m *Metrics) observe(method string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.requests[method]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+		m.requests[method] = h
+	}
+	i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+	h.counts[i]++
+	h.sum += d.Seconds()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+func (m *Metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.progress != nil {
+		state := m.progress.State()
+		fmt.Fprintf(w, "# HELP s3put_transferred_bytes_total Bytes of the files transferred completely.\n")
+		fmt.Fprintf(w, "# TYPE s3put_transferred_bytes_total counter\n")
+		fmt.Fprintf(w, "s3put_transferred_bytes_total %d\n", state.Done)
+		fmt.Fprintf(w, "# HELP s3put_objects_total Files processed by result.\n")
+		fmt.Fprintf(w, "# TYPE s3put_objects_total counter\n")
+		fmt.Fprintf(w, "s3put_objects_total{result=\"transferred\"} %d\n", state.Stats.Transferred)
+		fmt.Fprintf(w, "s3put_objects_total{result=\"skipped\"} %d\n", state.Stats.Skipped)
+		fmt.Fprintf(w, "s3put_objects_total{result=\"failed\"} %d\n", state.Stats.Failed)
+		fmt.Fprintf(w, "# HELP s3put_workers_busy Workers transferring a file.\n")
+		fmt.Fprintf(w, "# TYPE s3put_workers_busy gauge\n")
+		fmt.Fprintf(w, "s3put_workers_busy %d\n", state.Busy)
+		fmt.Fprintf(w, "# HELP s3put_workers Workers transferring files concurrently.\n")
+		fmt.Fprintf(w, "# TYPE s3put_workers gauge\n")
+		fmt.Fprintf(w, "s3put_workers %d\n", m.workers)
+	}
+
+	methods := make([]string, 0, len(m.requests))
+	for method := range m.requests {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	fmt.Fprintf(w, "# HELP s3put_request_duration_seconds Latency of HTTP requests.\n")
+	fmt.Fprintf(w, "# TYPE s3put_request_duration_seconds histogram\n")
+	for _, method := range methods {
+		h := m.requests[method]
+		var n int64
+		for i, bound := range latencyBuckets {
+			n += h.counts[i]
+			fmt.Fprintf(w, "s3put_request_duration_seconds_bucket{method=%q,le=\"%s\"} %d\n", method, strconv.FormatFloat(bound, 'g', -1, 64), n)
+		}
+		n += h.counts[len(latencyBuckets)]
+		fmt.Fprintf(w, "s3put_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, n)
+		fmt.Fprintf(w, "s3put_request_duration_seconds_sum{method=%q} %g\n", method, h.sum)
+		fmt.Fprintf(w, "s3put_request_duration_seconds_count{method=%q} %d\n", method, n)
+	}
+}
+
+// MetricsRoundTripper records the latency of every request.
+type MetricsRoundTripper struct {
+	http.RoundTripper
+	Metrics *Metrics
+}
+
+func (mrt *MetricsRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := mrt.RoundTripper.RoundTrip(r)
+	mrt.Metrics.observe(r.Method, time.Since(start))
+	return resp, err
+}
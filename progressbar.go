@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// ProgressBar shows the state of the transfers tracked by a Progress
+// in a line that is redrawn regularly. Log messages are printed above
+// it. If the output isn't a terminal, the line is printed every few
+// seconds instead.
+type ProgressBar struct {
+	progress *storage.Progress
+	out      *os.File
+	terminal bool
+	// workers adds a line for each running transfer above the bar.
+	workers bool
+	// logOut is where log messages went before.
+	logOut  io.Writer
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu sync.Mutex
+	// lines are the lines drawn last.
+	lines []string
+	// width is the width of the terminal, as checked at widthTime.
+	width     int
+	widthTime time.Time
+	// Recent amounts of transferred bytes, to calculate
+	// the current throughput.
+	samples []progressSample
+	// Recent amounts of bytes read by each worker
+	// from its item, to calculate its throughput.
+	workerItems   []*storage.Item
+	workerSamples [][]progressSample
+}
+
+type progressSample struct {
+	time  time.Time
+	bytes int64
+}
+
+// ShowProgress starts drawing a progress bar for p on out.
+func ShowProgress(p *storage.Progress, out *os.File) *ProgressBar {
+	return showProgress(p, out, false)
+}
+
+// ShowDashboard is like ShowProgress, but also shows the file, progress
+// and throughput of every running transfer if out is a terminal.
+func ShowDashboard(p *storage.Progress, out *os.File) *ProgressBar {
+	return showProgress(p, out, true)
+}
+
+func showProgress(p *storage.Progress, out *os.File, workers bool) *ProgressBar {
+	b := &ProgressBar{
+		progress: p,
+		out:      out,
+		terminal: isTerminal(out),
+		logOut:   log.Writer(),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	b.workers = workers && b.terminal
+	interval := 10 * time.Second
+	if b.terminal {
+		interval = 200 * time.Millisecond
+		log.SetOutput(b)
+	}
+	go func() {
+		defer close(b.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.update()
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return b
+}
+
+// Stop draws the bar a last time and removes it from the log output.
+func (b *ProgressBar) Stop() {
+	close(b.done)
+	<-b.stopped
+	b.update()
+	if b.terminal {
+		fmt.Fprintln(b.out)
+		log.SetOutput(b.logOut)
+	}
+}
+
+// Write prints a log message above the bar.
+func (b *ProgressBar) Write(data []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprint(b.out, b.clear())
+	n, err := b.logOut.Write(data)
+	fmt.Fprint(b.out, strings.Join(b.lines, "\n"))
+	return n, err
+}
+
+func (b *ProgressBar) update() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	s := b.progress.State()
+	var lines []string
+	if b.workers {
+		if now.Sub(b.widthTime) >= time.Second {
+			b.width, b.widthTime = terminalWidth(b.out), now
+		}
+		lines = b.renderWorkers(s.Workers, now)
+	}
+	lines = append(lines, b.render(s, now))
+	if b.terminal {
+		fmt.Fprint(b.out, b.clear()+strings.Join(lines, "\n"))
+	} else {
+		fmt.Fprintln(b.out, lines[len(lines)-1])
+	}
+	b.lines = lines
+}
+
+// clear returns the escape sequences to remove the lines drawn last.
+func (b *ProgressBar) clear() string {
+	if len(b.lines) <= 1 {
+		return "\r\033[K"
+	}
+	return fmt.Sprintf("\r\033[%dA\033[J", len(b.lines)-1)
+}
+
+// render formats s as a line like
+//
+//	[=========>          ]  45%  120/300 files  1.2 GiB/3.4 GiB  5.0 MiB/s  ETA 7m30s
+//
+// Totals still being counted are marked with a `+`. Without totals,
+// there's no bar and no ETA.
+func (b *ProgressBar) render(s storage.ProgressState, now time.Time) string {
+	b.samples = append(b.samples, progressSample{now, s.Transferred})
+	for len(b.samples) > 1 && now.Sub(b.samples[0].time) > 5*time.Second {
+		b.samples = b.samples[1:]
+	}
+	first := b.samples[0]
+	speed := storage.Rate(s.Transferred-first.bytes, now.Sub(first.time))
+
+	var fields []string
+	switch {
+	case s.Counted:
+		fraction := 1.0
+		if s.TotalBytes > 0 {
+			fraction = float64(s.Processed) / float64(s.TotalBytes)
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		fields = append(fields,
+			progressBar(fraction, 20),
+			fmt.Sprintf("%3d%%", int(fraction*100)),
+			fmt.Sprintf("%d/%d files", s.Files, s.TotalFiles),
+			fmt.Sprintf("%s/%s", storage.FormatSize(s.Processed), storage.FormatSize(s.TotalBytes)))
+	case s.Counting:
+		fields = append(fields,
+			fmt.Sprintf("%d/%d+ files", s.Files, s.TotalFiles),
+			fmt.Sprintf("%s/%s+", storage.FormatSize(s.Processed), storage.FormatSize(s.TotalBytes)))
+	default:
+		fields = append(fields,
+			fmt.Sprintf("%d files", s.Files),
+			storage.FormatSize(s.Processed))
+	}
+	fields = append(fields, storage.FormatSize(speed)+"/s")
+	if s.Counted && speed > 0 && s.Processed < s.TotalBytes {
+		eta := time.Duration(float64(s.TotalBytes-s.Processed) / float64(speed) * float64(time.Second))
+		fields = append(fields, "ETA "+eta.Round(time.Second).String())
+	}
+	return strings.Join(fields, "  ")
+}
+
+// progressBar draws a bar of width characters that is filled to fraction.
+func progressBar(fraction float64, width int) string {
+	filled := int(fraction * float64(width))
+	if filled >= width {
+		return "[" + strings.Repeat("=", width) + "]"
+	}
+	return "[" + strings.Repeat("=", filled) + ">" + strings.Repeat(" ", width-filled-1) + "]"
+}
+
+// maxWorkerLines limits the lines of the running transfers,
+// so that the dashboard fits into the terminal.
+const maxWorkerLines = 20
+
+// renderWorkers formats a line for every worker that is transferring
+// a file, like
+//
+//	#3   img/header.jpg  [====>     ]  45%     5.4 MiB/  12.0 MiB     2.1 MiB/s        3s
+//
+// The names of files are shortened to fit the lines into the terminal.
+func (b *ProgressBar) renderWorkers(workers []storage.WorkerState, now time.Time) []string {
+	if len(b.workerSamples) != len(workers) {
+		b.workerItems = make([]*storage.Item, len(workers))
+		b.workerSamples = make([][]progressSample, len(workers))
+	}
+	var lines []string
+	busy := 0
+	for i, w := range workers {
+		if w.Item != b.workerItems[i] {
+			b.workerItems[i], b.workerSamples[i] = w.Item, nil
+		}
+		if w.Item == nil {
+			continue
+		}
+		samples := append(b.workerSamples[i], progressSample{now, w.Read})
+		for len(samples) > 1 && now.Sub(samples[0].time) > 5*time.Second {
+			samples = samples[1:]
+		}
+		b.workerSamples[i] = samples
+		busy++
+		if busy > maxWorkerLines {
+			continue
+		}
+		read, size := w.Read, w.Item.Size
+		if read > size {
+			read = size
+		}
+		fraction := 1.0
+		if size > 0 {
+			fraction = float64(read) / float64(size)
+		}
+		stats := fmt.Sprintf("%s %3d%%  %10s/%10s  %10s/s  %8s",
+			progressBar(fraction, 10), int(fraction*100), storage.FormatSize(read), storage.FormatSize(size),
+			storage.FormatSize(storage.Rate(w.Read-samples[0].bytes, now.Sub(samples[0].time))),
+			now.Sub(w.Started).Round(time.Second))
+		worker := fmt.Sprintf("#%-3d ", i+1)
+		width := b.width - len(worker) - len(stats) - 2
+		lines = append(lines, worker+fitWidth(w.Item.Key(), width)+"  "+stats)
+	}
+	if busy > maxWorkerLines {
+		lines = append(lines, fmt.Sprintf("     ... and %d more", busy-maxWorkerLines))
+	}
+	return lines
+}
+
+// fitWidth pads name to width characters or shortens it by replacing
+// its beginning with `...`.
+func fitWidth(name string, width int) string {
+	if width < 10 {
+		width = 10
+	}
+	runes := []rune(name)
+	if len(runes) > width {
+		return "..." + string(runes[len(runes)-width+3:])
+	}
+	return name + strings.Repeat(" ", width-len(runes))
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/surma/s3put/storage"
+)
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// promptKeys asks for the access key and the secret key on w, unless
+// they are already set in keys, and reads them from in. If in is a
+// terminal, the secret key is not echoed.
+func promptKeys(in *os.File, w io.Writer, keys storage.AWSKeys) (storage.AWSKeys, error) {
+	br := bufio.NewReader(in)
+	for _, field := range []struct {
+		prompt string
+		value  *string
+		hidden bool
+	}{
+		{"AWS Access Key ID: ", &keys.AccessKey, false},
+		{"AWS Secret Access Key: ", &keys.SecretKey, true},
+	} {
+		if *field.value != "" {
+			continue
+		}
+		fmt.Fprint(w, field.prompt)
+		var line string
+		var err error
+		if field.hidden && isTerminal(in) {
+			line, err = readHidden(in, br)
+			fmt.Fprintln(w)
+		} else {
+			line, err = br.ReadString('\n')
+		}
+		if err != nil && (err != io.EOF || line == "") {
+			return storage.AWSKeys{}, err
+		}
+		*field.value = strings.TrimSpace(line)
+		if *field.value == "" {
+			return storage.AWSKeys{}, errors.New("No key entered")
+		}
+	}
+	return keys, nil
+}
+
+// readHidden reads a line from the terminal in without echoing it.
+func readHidden(in *os.File, br *bufio.Reader) (string, error) {
+	err := setEcho(in, false)
+	if err != nil {
+		return "", err
+	}
+	// Don't leave the terminal without echo when interrupted.
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-interrupt:
+			setEcho(in, true)
+			os.Exit(ExitAborted)
+		case <-done:
+		}
+	}()
+	defer func() {
+		signal.Stop(interrupt)
+		close(done)
+		setEcho(in, true)
+	}()
+	return br.ReadString('\n')
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/surma/s3put/storage"
+)
+
+func TestPromptKeysAsksForMissingKeys(t *testing.T) {
+	f, err := ioutil.TempFile("", "s3put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.WriteString("entered\n")
+
+	tests := []struct {
+		given, want storage.AWSKeys
+		prompts     string
+	}{
+		{storage.AWSKeys{AccessKey: "given"}, storage.AWSKeys{AccessKey: "given", SecretKey: "entered"}, "AWS Secret Access Key: "},
+		{storage.AWSKeys{SecretKey: "given"}, storage.AWSKeys{AccessKey: "entered", SecretKey: "given"}, "AWS Access Key ID: "},
+	}
+	for _, test := range tests {
+		f.Seek(0, 0)
+		var w bytes.Buffer
+		got, err := promptKeys(f, &w, test.given)
+		if err != nil || got != test.want || w.String() != test.prompts {
+			t.Errorf("Got %+v, %v after prompts %q, want %+v after %q", got, err, w.String(), test.want, test.prompts)
+		}
+	}
+}
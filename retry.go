@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// FailedRun is what --save-failed records about a run: The files that
+// could not be transferred and where they were transferred between,
+// so that `retry-failed` can transfer just them again instead of
+// listing everything.
+type FailedRun struct {
+	Verb   string `json:"verb"`
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix,omitempty"`
+	// Path is the absolute local path.
+	Path string `json:"path"`
+	// Keys are the paths of the failed files relative
+	// to the prefix or the local path, respectively.
+	Keys []string `json:"keys"`
+}
+
+func WriteFailedRun(path string, run *FailedRun) error {
+	if run.Keys == nil {
+		run.Keys = []string{}
+	}
+	data, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func ReadFailedRun(path string) (*FailedRun, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	run := &FailedRun{}
+	err = json.Unmarshal(data, run)
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
@@ -1,119 +1,1123 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"text/tabwriter"
+	"time"
 
+	"github.com/surma/s3put/storage"
 	"github.com/voxelbrain/goptions"
+	"gopkg.in/amz.v1/s3"
 )
 
 const (
 	VERSION = "3.0.3"
 )
 
+// watchDelay is how long files must not have changed
+// before they are uploaded with --watch.
+const watchDelay = 2 * time.Second
+
 var (
 	options = struct {
-		Concurrency  int           `goptions:"-c, --concurrency, description='Number of coroutines'"`
-		Continue     bool          `goptions:"--continue, description='Continue on error'"`
-		Prefix       string        `goptions:"-p, --prefix, description='Prefix to apply to remote storage'"`
-		CacheControl string        `goptions:"--cache-control, description='Set Cache-Control header on upload'"`
-		AccessKey    string        `goptions:"-k, --access-key, obligatory, description='AWS Access Key ID'"`
-		SecretKey    string        `goptions:"-s, --secret-key, obligatory, description='AWS Secret Access Key'"`
-		Bucket       string        `goptions:"-b, --bucket, obligatory, description='Bucket URL to push to'"`
-		Help         goptions.Help `goptions:"-h, --help, description='Show this help'"`
+		Concurrency   int           `goptions:"-c, --concurrency, description='Number of coroutines'"`
+		Continue      bool          `goptions:"--continue, mutexgroup='errors', description='Continue on error'"`
+		MaxErrors     int64         `goptions:"--max-errors, mutexgroup='errors', description='Continue on error, but abort once this many files have failed'"`
+		Prefix        string        `goptions:"-p, --prefix, description='Prefix to apply to remote storage'"`
+		CacheControl  string        `goptions:"--cache-control, description='Set Cache-Control header on upload'"`
+		CacheRules    []string      `goptions:"--cache-control-rule, description='Set Cache-Control header on uploads matching a pattern (pattern=value, repeatable)'"`
+		Header        []string      `goptions:"--header, description='Send this header with uploads (Name: value, repeatable)'"`
+		Metadata      []string      `goptions:"--metadata, description='Add metadata to uploads (key=value, repeatable)'"`
+		Gzip          bool          `goptions:"--gzip, description='Compress uploads with gzip'"`
+		GzipPatterns  []string      `goptions:"--gzip-pattern, description='Only compress uploads matching this pattern (repeatable, implies --gzip)'"`
+		KeepGzip      bool          `goptions:"--keep-compressed, description='Do not decompress gzip-encoded objects on get'"`
+		Disposition   string        `goptions:"--content-disposition, description='Set Content-Disposition header on upload ({filename} is replaced)'"`
+		Expires       string        `goptions:"--expires, description='Set Expires header on upload to this time or duration from now'"`
+		ContentType   string        `goptions:"--content-type, description='Set Content-Type header of all uploads'"`
+		MimeMap       string        `goptions:"--mime-map, description='Load additional extension to Content-Type mappings from this file'"`
+		ACL           string        `goptions:"--acl, description='Canned ACL of uploaded objects (e.g. private, public-read)'"`
+		StorageClass  string        `goptions:"--storage-class, description='Storage class of uploaded objects (e.g. STANDARD_IA, GLACIER)'"`
+		SSEKMSKeyId   string        `goptions:"--sse-kms-key-id, description='Encrypt uploads with this KMS key (ID or ARN)'"`
+		SSECKeyFile   string        `goptions:"--sse-c-key-file, description='Encrypt and decrypt objects with the key in this file (SSE-C)'"`
+		BwLimit       string        `goptions:"--bwlimit, description='Limit total bandwidth per second (e.g. 10M)'"`
+		Progress      bool          `goptions:"--progress, mutexgroup='display', description='Show a progress bar instead of logging each file'"`
+		TUI           bool          `goptions:"--tui, mutexgroup='display', description='Show a progress bar and the progress of every running transfer instead of logging each file'"`
+		ProgressSize  string        `goptions:"--progress-size, description='Log the progress of files at least this big every 10 seconds (0 to disable)'"`
+		SkipExisting  bool          `goptions:"--skip-existing, mutexgroup='overwrite', description='Skip files that already exist with the same content'"`
+		NoClobber     bool          `goptions:"--no-clobber, mutexgroup='overwrite', description='Never overwrite existing files'"`
+		Force         bool          `goptions:"--force, mutexgroup='overwrite', description='Always overwrite existing files (default)'"`
+		IfNewer       bool          `goptions:"--if-newer, mutexgroup='overwrite', description='Only overwrite files that are older than the source'"`
+		SizeOnly      bool          `goptions:"--size-only, mutexgroup='overwrite', description='Only overwrite files with a different size'"`
+		Include       []string      `goptions:"--include, description='Transfer files matching this pattern (repeatable)'"`
+		Exclude       []string      `goptions:"--exclude, description='Skip files matching this pattern (repeatable)'"`
+		IncludeFrom   []string      `goptions:"--include-from, description='Read include patterns from this file (repeatable)'"`
+		ExcludeFrom   []string      `goptions:"--exclude-from, description='Read exclude patterns from this file (repeatable)'"`
+		FilterRegex   []string      `goptions:"--filter-regex, description='Only transfer files matching this regular expression (repeatable)'"`
+		ExcludeRegex  []string      `goptions:"--exclude-regex, description='Skip files matching this regular expression (repeatable)'"`
+		MinSize       string        `goptions:"--min-size, description='Skip files smaller than this (e.g. 5M)'"`
+		MaxSize       string        `goptions:"--max-size, description='Skip files bigger than this (e.g. 1G)'"`
+		NewerThan     string        `goptions:"--newer-than, description='Skip files modified before this time or duration ago (e.g. 24h)'"`
+		OlderThan     string        `goptions:"--older-than, description='Skip files modified after this time or duration ago'"`
+		MaxDepth      int           `goptions:"--max-depth, description='Only upload files this many directory levels deep'"`
+		ExcludeHidden bool          `goptions:"--exclude-hidden, description='Skip files and directories starting with a dot'"`
+		FollowLinks   bool          `goptions:"--follow-symlinks, mutexgroup='symlinks', description='Follow symlinks to directories'"`
+		SkipLinks     bool          `goptions:"--skip-symlinks, mutexgroup='symlinks', description='Skip all symlinks'"`
+		PreservePerms bool          `goptions:"--preserve-perms, description='Apply stored permissions and ownership on get'"`
+		TagFilter     []string      `goptions:"--tag, description='Only get objects with this tag (key=value, key!=value or key, repeatable)'"`
+		VersionId     string        `goptions:"--version-id, description='Get this version of the objects'"`
+		AsOf          string        `goptions:"--as-of, description='Get the objects as they were at this time or duration ago'"`
+		RestoreDays   int           `goptions:"--restore-days, description='Keep restored copies of archived objects for this many days'"`
+		RestoreTier   string        `goptions:"--restore-tier, description='Retrieval tier of restores (Standard, Bulk or Expedited)'"`
+		RestoreWait   bool          `goptions:"--restore-wait, description='Wait until archived objects are restored (restores them first on get)'"`
+		SQL           string        `goptions:"--sql, description='SQL expression to run with select'"`
+		SelectFormat  string        `goptions:"--select-format, description='Format of the object to select from (csv, json or jsonl, default: by extension)'"`
+		SelectHeader  bool          `goptions:"--select-header, description='Use the first CSV line as column names in select'"`
+		FilesFrom     string        `goptions:"--files-from, description='Only transfer the files listed in this file (- for stdin)'"`
+		From0         bool          `goptions:"--from0, description='Paths in --files-from are separated by NUL'"`
+		FromURLs      string        `goptions:"--from-urls, description='Put the files at the URLs listed in this file instead of local files (- for stdin)'"`
+		Watch         bool          `goptions:"--watch, description='Keep uploading files as they are created or modified until interrupted (put only)'"`
+		AccessKey     string        `goptions:"-k, --access-key, description='AWS Access Key ID (default: $AWS_ACCESS_KEY_ID, profile or ECS/EC2 role, not needed for gs://, file:// and anonymous ftp:// or webdav://)'"`
+		SecretKey     string        `goptions:"-s, --secret-key, description='AWS Secret Access Key (default: $AWS_SECRET_ACCESS_KEY, profile or ECS/EC2 role, not needed for gs://, file:// and anonymous ftp:// or webdav://)'"`
+		SessionToken  string        `goptions:"--session-token, description='Session token of temporary keys (default: $AWS_SESSION_TOKEN if the keys are taken from the environment)'"`
+		Profile       string        `goptions:"--profile, description='Use the keys of this profile in the keyring, ~/.aws/credentials or ~/.aws/config (default: $AWS_PROFILE or default)'"`
+		RoleArn       string        `goptions:"--role-arn, description='Assume this IAM role before transferring'"`
+		ExternalId    string        `goptions:"--external-id, description='External ID required to assume the role'"`
+		RoleSession   string        `goptions:"--role-session-name, description='Session name of the assumed role (default: s3put-<timestamp>)'"`
+		Credentials   string        `goptions:"--credentials, description='Google service account key file for gs:// (default: application default credentials)'"`
+		Bucket        string        `goptions:"-b, --bucket, description='Bucket URL or name to push to (*)'"`
+		Region        string        `goptions:"--region, description='Region of the bucket if only its name is given (default: detected)'"`
+		PathStyle     bool          `goptions:"--path-style, mutexgroup='addressing', description='Address the bucket in the URL path (default)'"`
+		VirtualHosted bool          `goptions:"--virtual-hosted, mutexgroup='addressing', description='Address the bucket as a subdomain of the endpoint'"`
+		Endpoint      string        `goptions:"--endpoint, description='URL of an S3-compatible server to use with a bucket name (e.g. MinIO)'"`
+		Proxy         string        `goptions:"--proxy, description='Send requests to the storage through this HTTP or HTTPS proxy (default: $HTTPS_PROXY or $HTTP_PROXY, except for hosts in $NO_PROXY)'"`
+		SOCKS5        string        `goptions:"--socks5, description='Send requests to the storage through this SOCKS5 proxy (host:port or user:password@host:port)'"`
+		CACert        string        `goptions:"--ca-cert, description='Trust the certificates in this PEM file in addition to the system ones'"`
+		Insecure      bool          `goptions:"--insecure, description='Do not verify the TLS certificate of the storage (dangerous)'"`
+		MaxIdleConns  int           `goptions:"--max-idle-conns, description='Keep at most this many idle connections to the storage open (default: concurrency, at least 100 in total)'"`
+		IdleTimeout   string        `goptions:"--idle-timeout, description='Close connections that have been idle for this long (default: 90s)'"`
+		NoKeepAlive   bool          `goptions:"--no-keep-alive, description='Open a new connection for every request'"`
+		Config        string        `goptions:"--config, description='Read remotes and jobs from this file (default: ~/.s3put.toml)'"`
+		Quiet         bool          `goptions:"-q, --quiet, mutexgroup='verbosity', description='Only log errors'"`
+		Verbose       []bool        `goptions:"-v, --verbose, mutexgroup='verbosity', description='Log more details (-vv logs every request)'"`
+		LogFormat     string        `goptions:"--log-format, description='Format of the log (text or json)'"`
+		LogFile       string        `goptions:"--log-file, mutexgroup='logto', description='Append the log to this file, too'"`
+		LogSyslog     bool          `goptions:"--log-syslog, mutexgroup='logto', description='Log to syslog instead of stderr'"`
+		SummaryJSON   string        `goptions:"--summary-json, description='Write the statistics and failed files of the run as JSON to this file (- for stdout)'"`
+		Manifest      string        `goptions:"--manifest, description='Record the transferred objects with size, MD5 and time in this CSV or .json file'"`
+		MetricsAddr   string        `goptions:"--metrics-addr, description='Serve Prometheus metrics at http://<address>/metrics (e.g. :9100)'"`
+		StatsD        string        `goptions:"--statsd, description='Send metrics of every transfer to this StatsD server (host:port)'"`
+		OTLPEndpoint  string        `goptions:"--otlp-endpoint, description='Export traces of the transfers to this OpenTelemetry collector (e.g. http://localhost:4318)'"`
+		SlackWebhook  string        `goptions:"--slack-webhook, description='Post the outcome of the run to this Slack webhook URL (default: $S3PUT_SLACK_WEBHOOK)'"`
+		Pipe          string        `goptions:"--pipe, description='Stream files through this command before uploading them (e.g. gpg --encrypt)'"`
+		Unpipe        string        `goptions:"--unpipe, description='Stream downloaded files through this command (e.g. gpg --decrypt)'"`
+		OnComplete    string        `goptions:"--on-complete, description='Run this command after each transferred file (see README for its environment)'"`
+		OnError       string        `goptions:"--on-error, description='Run this command after each file that failed'"`
+		OnFinish      string        `goptions:"--on-finish, description='Run this command after the whole run'"`
+		APIAddr       string        `goptions:"--api-addr, description='Serve an API to query and run the jobs of daemon at http://<address>/jobs (e.g. localhost:8080)'"`
+		SaveFailed    string        `goptions:"--save-failed, description='Save the files that failed to this file for retry-failed (needs --continue or --max-errors)'"`
+		Help          goptions.Help `goptions:"-h, --help, description='Show this help'"`
 		goptions.Remainder
 
 		goptions.Verbs
-		Put struct{} `goptions:"put"`
-		Get struct{} `goptions:"get"`
+		Put         struct{} `goptions:"put"`
+		Get         struct{} `goptions:"get"`
+		Check       struct{} `goptions:"check"`
+		Versions    struct{} `goptions:"versions"`
+		Undelete    struct{} `goptions:"undelete"`
+		Restore     struct{} `goptions:"restore"`
+		Select      struct{} `goptions:"select"`
+		Login       struct{} `goptions:"login"`
+		RetryFailed struct{} `goptions:"retry-failed"`
+		Daemon      struct{} `goptions:"daemon"`
 	}{
-		Concurrency: 10,
+		Concurrency:  10,
+		ACL:          string(s3.PublicRead),
+		RestoreDays:  1,
+		RestoreTier:  "Standard",
+		ProgressSize: "100M",
+		LogFormat:    "text",
 	}
+	// limiter limits the bandwidth of the storage if --bwlimit is given.
+	limiter      *storage.RateLimiter
+	progressSize int64
+	filter       storage.Filter
+	regexFilter  *storage.RegexFilter
+	sizeRange    storage.SizeRange
+	timeRange    storage.TimeRange
+	asOf         time.Time
+	filesFrom    []string
+	fromURLs     []string
+	// metrics records the requests if --metrics-addr is given.
+	metrics *Metrics
+	// jobs are the jobs in the config file run by daemon.
+	jobs map[string]*Job
+	// failedRun is the run whose failed files retry-failed transfers.
+	failedRun *FailedRun
+	// awsCredentials are used if no keys are given on the command line.
+	awsCredentials *storage.AWSCredentials
+	// remoteFilter holds the patterns of a remote from the config file,
+	// which apply after those given on the command line.
+	remoteFilter storage.Filter
+	// aclGiven is set if the ACL has been chosen explicitly.
+	aclGiven bool
+	// httpTransport is the transport of httpClient
+	// before it is wrapped to log, trace or measure requests.
+	httpTransport = storage.NewTransport()
+	// httpClient sends the requests of the storages.
+	httpClient = &http.Client{Transport: httpTransport}
 )
 
-func init() {
+// parseOptions parses the command line and sets up s3put accordingly.
+// It is called by main rather than init, so that tests don't parse
+// their flags.
+func parseOptions() {
 	flagSet := goptions.NewFlagSet(filepath.Base(os.Args[0]), &options)
 	flagSet.HelpFunc = helpFunc
 	err := flagSet.Parse(os.Args[1:])
-	if err != nil || len(options.Remainder) <= 0 || len(options.Verbs) <= 0 {
+	aclGiven = flagGiven("--acl")
+	config, cerr := LoadConfig(options.Config)
+	if cerr != nil {
+		exitf(ExitConfig, "Could not load config: %s", cerr)
+	}
+	// A remote from the config file takes the place of --bucket.
+	if err == nil && options.Bucket == "" && len(options.Remainder) > 0 {
+		if remote, p, ok := config.ParseRemote(options.Remainder[0]); ok {
+			applyRemote(remote, p)
+			options.Remainder = options.Remainder[1:]
+		}
+	}
+	// retry-failed repeats the put or get saved by --save-failed.
+	if err == nil && options.Verbs == "retry-failed" && len(options.Remainder) > 0 {
+		failedRun, err = ReadFailedRun(options.Remainder[0])
+		if err != nil {
+			exitf(ExitConfig, "Could not read %s: %s", options.Remainder[0], err)
+		}
+		if failedRun.Verb != "put" && failedRun.Verb != "get" {
+			exitf(ExitConfig, "Invalid verb %s in %s", failedRun.Verb, options.Remainder[0])
+		}
+		options.Verbs = goptions.Verbs(failedRun.Verb)
+		options.Remainder = []string{failedRun.Path}
+		if options.Bucket == "" {
+			options.Bucket, options.Prefix = failedRun.Bucket, failedRun.Prefix
+		}
+	}
+	// `versions`, `undelete` and `restore` don't need a local path,
+	// neither does `put` with a list of URLs. `login` and `daemon`
+	// need neither a path nor a bucket.
+	needsPath := !contains([]string{"versions", "undelete", "restore", "login", "daemon"}, string(options.Verbs)) &&
+		!(options.Verbs == "put" && options.FromURLs != "")
+	needsBucket := options.Verbs != "login" && options.Verbs != "daemon"
+	if err != nil || (needsPath && len(options.Remainder) <= 0) || (needsBucket && options.Bucket == "") || len(options.Verbs) <= 0 {
 		if err != goptions.ErrHelpRequest && err != nil {
 			log.Printf("Error: %s", err)
 		}
 		flagSet.PrintHelp(os.Stderr)
-		os.Exit(1)
+		os.Exit(ExitConfig)
+	}
+	if options.APIAddr != "" && options.Verbs != "daemon" {
+		exitf(ExitConfig, "--api-addr is only supported for daemon")
+	}
+	if options.Verbs == "daemon" {
+		if len(config.Jobs) == 0 {
+			exitf(ExitConfig, "There are no jobs in the config file")
+		}
+		jobs = config.Jobs
+	}
+
+	var logOut io.Writer = os.Stderr
+	if options.LogFile != "" {
+		logFile, err := OpenLogFile(options.LogFile)
+		if err != nil {
+			exitf(ExitConfig, "Could not open log file: %s", err)
+		}
+		logOut = io.MultiWriter(os.Stderr, logFile)
+	}
+	if options.LogSyslog {
+		sysLog, err = openSyslog()
+		if err != nil {
+			exitf(ExitConfig, "Could not connect to syslog: %s", err)
+		}
+		// Syslog adds timestamps itself.
+		log.SetFlags(0)
+		logOut = SyslogWriter{sysLog}
+	}
+	switch options.LogFormat {
+	case "text":
+		log.SetOutput(logOut)
+	case "json":
+		jsonLog = true
+		log.SetFlags(0)
+		log.SetOutput(&JSONLogWriter{logOut})
+	default:
+		exitf(ExitConfig, "Invalid log format %s, must be text or json", options.LogFormat)
+	}
+	switch {
+	case options.Proxy != "" && options.SOCKS5 != "":
+		exitf(ExitConfig, "--proxy and --socks5 can't be used together")
+	case options.Proxy != "":
+		if err := storage.SetProxy(httpTransport, options.Proxy); err != nil {
+			exitf(ExitConfig, "%s", err)
+		}
+	case options.SOCKS5 != "":
+		if err := storage.SetSOCKS5Proxy(httpTransport, options.SOCKS5); err != nil {
+			exitf(ExitConfig, "%s", err)
+		}
+	}
+	if options.CACert != "" {
+		if err := storage.AddCACerts(httpTransport, options.CACert); err != nil {
+			exitf(ExitConfig, "Could not load CA certificates: %s", err)
+		}
+	}
+	if options.Insecure {
+		log.Printf("WARNING: --insecure disables TLS certificate verification, anyone between s3put and the storage can read and modify the transfers")
+		storage.SkipVerify(httpTransport)
+	}
+	// http.Transport only keeps 2 idle connections per host by default,
+	// so most workers would open a new connection for every request.
+	httpTransport.MaxIdleConnsPerHost = options.Concurrency
+	if httpTransport.MaxIdleConns < options.Concurrency {
+		httpTransport.MaxIdleConns = options.Concurrency
+	}
+	if options.MaxIdleConns > 0 {
+		httpTransport.MaxIdleConns = options.MaxIdleConns
+		httpTransport.MaxIdleConnsPerHost = options.MaxIdleConns
+	}
+	if options.IdleTimeout != "" {
+		d, err := time.ParseDuration(options.IdleTimeout)
+		if err != nil || d <= 0 {
+			exitf(ExitConfig, "Invalid duration %s for --idle-timeout", options.IdleTimeout)
+		}
+		httpTransport.IdleConnTimeout = d
+	}
+	httpTransport.DisableKeepAlives = options.NoKeepAlive
+	switch {
+	case options.Quiet:
+		logLevel = storage.LogQuiet
+	case len(options.Verbose) == 1:
+		logLevel = storage.LogVerbose
+	case len(options.Verbose) > 1:
+		logLevel = storage.LogDebug
+		httpClient.Transport = &LoggingRoundTripper{httpClient.Transport}
+	}
+	storage.SetLogger(logLevel, output)
+	if options.SlackWebhook == "" {
+		options.SlackWebhook = os.Getenv("S3PUT_SLACK_WEBHOOK")
+	}
+	if options.StatsD != "" {
+		statsd, err = DialStatsD(options.StatsD)
+		if err != nil {
+			exitf(ExitConfig, "Invalid StatsD address %s: %s", options.StatsD, err)
+		}
+	}
+	if options.OTLPEndpoint != "" {
+		tracer, err = NewTracer(options.OTLPEndpoint, 5*time.Second)
+		if err != nil {
+			exitf(ExitConfig, "%s", err)
+		}
+		httpClient.Transport = &TracingRoundTripper{httpClient.Transport}
+	}
+	if options.MetricsAddr != "" {
+		metrics = NewMetrics()
+		httpClient.Transport = &MetricsRoundTripper{httpClient.Transport, metrics}
+	}
+
+	if options.BwLimit != "" {
+		bwLimit, err := storage.ParseSize(options.BwLimit)
+		if err != nil || bwLimit <= 0 {
+			exitf(ExitConfig, "Invalid bandwidth limit %s", options.BwLimit)
+		}
+		limiter = storage.NewRateLimiter(bwLimit)
+		storage.LimitTransport(httpTransport, limiter)
+	}
+	progressSize, err = storage.ParseSize(options.ProgressSize)
+	if err != nil {
+		exitf(ExitConfig, "Invalid size %s for --progress-size", options.ProgressSize)
+	}
+
+	if !validACL(s3.ACL(options.ACL)) {
+		exitf(ExitConfig, "Invalid ACL %s, must be one of %s", options.ACL, strings.Join(aclNames(), ", "))
+	}
+
+	if options.StorageClass != "" {
+		options.StorageClass = strings.ToUpper(options.StorageClass)
+		if !contains(storage.StorageClasses, options.StorageClass) {
+			exitf(ExitConfig, "Invalid storage class %s, must be one of %s", options.StorageClass, strings.Join(storage.StorageClasses, ", "))
+		}
+	}
+
+	if !contains(storage.RestoreTiers, options.RestoreTier) || options.RestoreDays <= 0 {
+		exitf(ExitConfig, "Invalid restore options, tier must be one of %s and days must be positive", strings.Join(storage.RestoreTiers, ", "))
+	}
+
+	if options.SelectFormat != "" && !contains(storage.SelectFormats, options.SelectFormat) {
+		exitf(ExitConfig, "Invalid select format %s, must be one of %s", options.SelectFormat, strings.Join(storage.SelectFormats, ", "))
+	}
+	if options.Verbs == "select" && options.SQL == "" {
+		exitf(ExitConfig, "select needs an expression (--sql)")
+	}
+
+	if options.MimeMap != "" {
+		err = storage.LoadMimeMap(options.MimeMap)
+		if err != nil {
+			exitf(ExitConfig, "Could not load %s: %s", options.MimeMap, err)
+		}
+	}
+
+	filter, err = storage.ParseFilterArgs(os.Args[1:])
+	if err != nil {
+		exitf(ExitConfig, "Could not read filter patterns: %s", err)
+	}
+	filter = append(filter, remoteFilter...)
+	regexFilter, err = storage.NewRegexFilter(options.FilterRegex, options.ExcludeRegex)
+	if err != nil {
+		exitf(ExitConfig, "Invalid regular expression: %s", err)
+	}
+	if options.MinSize != "" {
+		sizeRange.Min, err = storage.ParseSize(options.MinSize)
+		if err != nil {
+			exitf(ExitConfig, "Invalid minimum size %s", options.MinSize)
+		}
+	}
+	if options.MaxSize != "" {
+		sizeRange.Max, err = storage.ParseSize(options.MaxSize)
+		if err != nil {
+			exitf(ExitConfig, "Invalid maximum size %s", options.MaxSize)
+		}
+	}
+	now := time.Now()
+	if options.NewerThan != "" {
+		timeRange.After, err = storage.ParseTime(options.NewerThan, now)
+		if err != nil {
+			exitf(ExitConfig, "Invalid --newer-than: %s", err)
+		}
+	}
+	if options.OlderThan != "" {
+		timeRange.Before, err = storage.ParseTime(options.OlderThan, now)
+		if err != nil {
+			exitf(ExitConfig, "Invalid --older-than: %s", err)
+		}
 	}
 
-	if options.CacheControl != "" {
-		log.Printf("Monkey patching default transport...")
-		monkeyPatchDefaultTransport()
+	if options.AsOf != "" {
+		asOf, err = storage.ParseTime(options.AsOf, now)
+		if err != nil {
+			exitf(ExitConfig, "Invalid --as-of: %s", err)
+		}
+	}
+
+	if options.FilesFrom != "" {
+		filesFrom, err = ReadFileList(options.FilesFrom, options.From0)
+		if err != nil {
+			exitf(ExitConfig, "Could not read %s: %s", options.FilesFrom, err)
+		}
+	}
+
+	if options.MaxErrors < 0 {
+		exitf(ExitConfig, "Invalid --max-errors %d", options.MaxErrors)
+	}
+	if options.SaveFailed != "" && !options.Continue && options.MaxErrors == 0 {
+		exitf(ExitConfig, "--save-failed needs --continue or --max-errors, otherwise the first failure aborts the run")
+	}
+	if options.SaveFailed != "" && options.FromURLs != "" {
+		exitf(ExitConfig, "--save-failed is not supported with --from-urls")
+	}
+	if failedRun != nil {
+		if options.FilesFrom != "" || options.FromURLs != "" {
+			exitf(ExitConfig, "retry-failed can't be combined with --files-from or --from-urls")
+		}
+		filesFrom = failedRun.Keys
+	}
+
+	if options.Pipe != "" && options.Verbs != "put" {
+		exitf(ExitConfig, "--pipe is only supported for put")
+	}
+	if options.Unpipe != "" && options.Verbs != "get" {
+		exitf(ExitConfig, "--unpipe is only supported for get")
+	}
+	if options.Watch {
+		if options.Verbs != "put" {
+			exitf(ExitConfig, "--watch is only supported for put")
+		}
+		if options.FilesFrom != "" || options.FromURLs != "" || failedRun != nil {
+			exitf(ExitConfig, "--watch can't be combined with --files-from, --from-urls or retry-failed")
+		}
+	}
+
+	if options.FromURLs != "" {
+		if options.Verbs != "put" {
+			exitf(ExitConfig, "--from-urls is only supported for put")
+		}
+		fromURLs, err = storage.ReadURLList(options.FromURLs)
+		if err != nil {
+			exitf(ExitConfig, "Could not read %s: %s", options.FromURLs, err)
+		}
 	}
 }
 
 func main() {
-	var s Storage
+	parseOptions()
+	var remote storage.Storage
+	var s *storage.S3Storage
 	var err error
 	verb := string(options.Verbs)
+	if verb == "login" {
+		Login()
+		return
+	}
+	if verb == "daemon" {
+		runDaemon()
+		return
+	}
+	// FTP and WebDAV use the keys as user name and password,
+	// so AWS keys must not be sent there.
+	usesAWSKeys := !hasAnyPrefix(options.Bucket, "gs://", "file://", "ftp://", "ftps://", "webdav://", "webdav+http://")
+	if usesAWSKeys {
+		switch {
+		case options.AccessKey == "" && options.SecretKey == "":
+			awsCredentials, err = storage.LookupAWSCredentials(options.Profile, httpClient)
+			if err == nil && awsCredentials != nil {
+				// Fail early instead of with every transfer.
+				_, err = awsCredentials.Get()
+			}
+			if err != nil {
+				exitf(ExitConfig, "Could not load AWS keys: %s", err)
+			}
+		case options.SessionToken != "":
+			awsCredentials = storage.StaticAWSCredentials(storage.AWSKeys{
+				AccessKey:    options.AccessKey,
+				SecretKey:    options.SecretKey,
+				SessionToken: options.SessionToken,
+			})
+		}
+	}
+	needsKeys := !hasAnyPrefix(options.Bucket, "gs://", "file://", "ftp://", "ftps://", "webdav://", "webdav+http://") && awsCredentials == nil
+	if needsKeys && (options.AccessKey == "" || options.SecretKey == "") {
+		if !usesAWSKeys || !isTerminal(os.Stdin) {
+			exitf(ExitConfig, "--access-key and --secret-key are required")
+		}
+		// Asking is friendlier for one-off transfers and keeps
+		// the keys out of the shell history.
+		keys, err := promptKeys(os.Stdin, os.Stderr, storage.AWSKeys{AccessKey: options.AccessKey, SecretKey: options.SecretKey})
+		if err != nil {
+			exitf(ExitConfig, "Could not read keys: %s", err)
+		}
+		options.AccessKey, options.SecretKey = keys.AccessKey, keys.SecretKey
+	}
+	if usesAWSKeys && options.RoleArn != "" {
+		source := awsCredentials
+		if source == nil {
+			source = storage.StaticAWSCredentials(storage.AWSKeys{AccessKey: options.AccessKey, SecretKey: options.SecretKey})
+		}
+		awsCredentials = storage.AssumeRoleCredentials(httpClient, source, options.RoleArn, options.ExternalId, options.RoleSession)
+		if _, err := awsCredentials.Get(); err != nil {
+			exitf(ExitConfig, "Could not assume role %s: %s", options.RoleArn, err)
+		}
+	}
 	switch {
-	case strings.HasPrefix(options.Bucket, "gcs:"):
-		bucket := strings.TrimPrefix(options.Bucket, "gcs://")
-		s, err = NewGcsStorage(options.AccessKey, options.SecretKey, "https://"+bucket, options.Prefix)
-	case strings.HasPrefix(options.Bucket, "s3:"):
-		bucket := strings.TrimPrefix(options.Bucket, "s3://")
-		log.Printf("Prefix: %s", bucket)
-		s, err = NewS3Storage(options.AccessKey, options.SecretKey, "https://"+bucket, options.Prefix)
+	case storage.Registered(options.Bucket):
+		remote, err = storage.Open(options.Bucket, storage.OpenOptions{
+			Prefix:        options.Prefix,
+			AccessKey:     options.AccessKey,
+			SecretKey:     options.SecretKey,
+			Credentials:   options.Credentials,
+			PreservePerms: options.PreservePerms,
+			Client:        httpClient,
+		})
+	case options.Endpoint != "":
+		if strings.Contains(options.Bucket, "/") {
+			exitf(ExitConfig, "--endpoint needs a bucket name, not a URL")
+		}
+		region := options.Region
+		if region == "" {
+			region = "us-east-1"
+		}
+		s, err = storage.NewS3EndpointStorage(options.AccessKey, options.SecretKey, options.Endpoint, region, options.Bucket, options.Prefix)
+	case !strings.Contains(options.Bucket, "/"):
+		region := options.Region
+		if region == "" {
+			region, err = storage.DetectBucketRegion(httpClient, options.Bucket)
+			if err != nil {
+				exitf(ExitConfig, "%s, use --region", err)
+			}
+		}
+		s, err = storage.NewS3Storage(options.AccessKey, options.SecretKey, storage.S3RegionByName(region).S3Endpoint+"/"+options.Bucket, options.Prefix)
 	default:
-		log.Fatalf("Bucket addresses must be of the form `gcs://...` or `s3://...` (see README)")
+		var forms []string
+		for _, scheme := range storage.Schemes() {
+			forms = append(forms, "`"+scheme+"://...`")
+		}
+		exitf(ExitConfig, "Bucket addresses must be of the form %s or a bucket name (see README)", strings.Join(forms, ", "))
 	}
 	if err != nil {
-		log.Fatalf("Invalid storage credentials: %s (use canonical endpoint name, see README)", err)
+		exitf(ExitConfig, "Invalid storage credentials: %s (use canonical endpoint name, see README)", err)
+	}
+	switch r := remote.(type) {
+	case *storage.S3Storage:
+		s = r
+	case *storage.GCSStorage:
+		configureGCSStorage(r)
+	case *storage.FTPStorage:
+		r.RateLimiter = limiter
+	}
+	if s != nil {
+		configureS3Storage(s)
+		remote = s
 	}
 
-	var dst Storage
-	var items <-chan *Item
+	ctx, stop := interruptContexts()
+	// The spans of the listing and the transfers are below
+	// one for the whole run.
+	var run, list *Span
+	if tracer != nil && (verb == "put" || verb == "get") {
+		ctx, run = tracer.Start(ctx, "s3put "+verb, spanKindInternal)
+		run.SetAttr("s3put.bucket", options.Bucket)
+		run.SetAttr("s3put.prefix", options.Prefix)
+		stop, list = tracer.Start(run.Context(stop), "list", spanKindInternal)
+	}
+	// src is the storage items are listed from, if all of its
+	// files are transferred.
+	var src, dst storage.Storage
+	var items, watched <-chan *storage.Item
+	var listErr <-chan error
 	switch verb {
 	case "put":
-		dst = s
-		ls := &LocalStorage{options.Remainder[0]}
-		items = ls.ListFiles()
+		dst = remote
+		if options.FromURLs != "" {
+			items, listErr = (&storage.URLStorage{URLs: fromURLs, Client: httpClient}).ListFiles(stop)
+			break
+		}
+		ls := &storage.LocalStorage{
+			Prefix:        options.Remainder[0],
+			MaxDepth:      options.MaxDepth,
+			ExcludeHidden: options.ExcludeHidden,
+		}
+		switch {
+		case options.FollowLinks:
+			ls.Symlinks = storage.SymlinkFollow
+		case options.SkipLinks:
+			ls.Symlinks = storage.SymlinkSkip
+		}
+		if options.Watch {
+			// Watch before the initial sync, so
+			// that no changes are missed.
+			var err error
+			watched, err = ls.WatchFiles(stop, watchDelay)
+			if err != nil {
+				exitf(ExitConfig, "Could not watch %s: %s", ls.Prefix, err)
+			}
+		}
+		if options.FilesFrom != "" || failedRun != nil {
+			items, listErr = ls.ListPaths(stop, filesFrom)
+		} else {
+			src = ls
+			items, listErr = ls.ListFiles(stop)
+		}
 	case "get":
-		dst = &LocalStorage{options.Remainder[0]}
-		items = s.ListFiles()
+		if options.RestoreWait {
+			requireS3Storage(s, "--restore-wait")
+			err := storage.Restore(stop, os.Stdout, s, true)
+			if err != nil {
+				exitf(ExitError, "Could not restore objects in bucket %s: %s", options.Bucket, err)
+			}
+		}
+		dst = &storage.LocalStorage{
+			Prefix:        options.Remainder[0],
+			PreservePerms: options.PreservePerms,
+		}
+		if options.FilesFrom != "" || failedRun != nil {
+			pl, ok := remote.(storage.PathLister)
+			if !ok {
+				exitf(ExitConfig, "--files-from is not supported for %s", options.Bucket)
+			}
+			items, listErr = pl.ListPaths(stop, filesFrom)
+		} else {
+			src = remote
+			items, listErr = remote.ListFiles(stop)
+		}
+	case "check":
+		requireS3Storage(s, verb)
+		ok, err := storage.Check(stop, os.Stdout, &storage.LocalStorage{Prefix: options.Remainder[0]}, s, options.SizeOnly)
+		if err != nil {
+			exitf(ExitError, "Could not check bucket %s: %s", options.Bucket, err)
+		}
+		if !ok {
+			os.Exit(ExitDifferent)
+		}
+		return
+	case "versions":
+		requireS3Storage(s, verb)
+		err := storage.PrintVersions(stop, os.Stdout, s)
+		if err != nil {
+			exitf(ExitError, "Could not list versions in bucket %s: %s", options.Bucket, err)
+		}
+		return
+	case "undelete":
+		requireS3Storage(s, verb)
+		err := storage.Undelete(stop, os.Stdout, s)
+		if err != nil {
+			exitf(ExitError, "Could not undelete objects in bucket %s: %s", options.Bucket, err)
+		}
+		return
+	case "restore":
+		requireS3Storage(s, verb)
+		err := storage.Restore(stop, os.Stdout, s, options.RestoreWait)
+		if err != nil {
+			exitf(ExitError, "Could not restore objects in bucket %s: %s", options.Bucket, err)
+		}
+		return
+	case "select":
+		requireS3Storage(s, verb)
+		err := storage.Select(stop, os.Stdout, s, options.Remainder[0], storage.SelectOptions{
+			Expression: options.SQL,
+			Format:     options.SelectFormat,
+			Header:     options.SelectHeader,
+		})
+		if err != nil {
+			exitf(ExitError, "Could not select from %s: %s", options.Remainder[0], err)
+		}
+		return
 	default:
-		log.Fatalf("Invalid/Missing `put` or `get`")
+		exitf(ExitConfig, "Invalid/Missing `put`, `get`, `check`, `versions`, `undelete`, `restore`, `select`, `login`, `retry-failed` or `daemon`")
+	}
+	if list != nil {
+		items = TraceItems(items, list)
+	}
+	items = filterItems(items)
+	policy := storage.OverwriteAlways
+	switch {
+	case options.SkipExisting:
+		policy = storage.OverwriteChanged
+	case options.NoClobber:
+		policy = storage.OverwriteNever
+	case options.IfNewer:
+		policy = storage.OverwriteOlder
+	case options.SizeOnly:
+		policy = storage.OverwriteChangedSize
+	}
+	var manifest *storage.Manifest
+	if options.Manifest != "" {
+		var err error
+		manifest, err = storage.CreateManifest(options.Manifest)
+		if err != nil {
+			exitf(ExitConfig, "Could not create manifest: %s", err)
+		}
+	}
+	if options.OnComplete != "" || options.OnError != "" || options.OnFinish != "" {
+		hooks = &Hooks{
+			OnComplete: options.OnComplete,
+			OnError:    options.OnError,
+			OnFinish:   options.OnFinish,
+			Env: []string{
+				"S3PUT_VERB=" + verb,
+				"S3PUT_BUCKET=" + options.Bucket,
+				"S3PUT_PREFIX=" + options.Prefix,
+			},
+		}
+		if len(options.Remainder) > 0 {
+			hooks.Env = append(hooks.Env, "S3PUT_LOCAL="+options.Remainder[0])
+		}
+	}
+	progress := storage.NewProgress(options.Concurrency)
+	progress.LargeFileSize = progressSize
+	if path := os.Getenv(ProgressFileEnv); path != "" {
+		go WriteProgress(ctx, path, progress, time.Second)
+	}
+	if metrics != nil {
+		err := metrics.Serve(options.MetricsAddr, progress, options.Concurrency)
+		if err != nil {
+			exitf(ExitConfig, "Could not serve metrics: %s", err)
+		}
+	}
+	var bar *ProgressBar
+	if options.Progress || options.TUI {
+		logTransfers = false
+		// Count the files to transfer in advance if that
+		// doesn't mean opening them.
+		if sl, ok := src.(storage.StatLister); ok {
+			if files := sl.StatFiles(stop); files != nil {
+				go progress.Count(filterItems(files))
+			}
+		}
+		if options.TUI {
+			bar = ShowDashboard(progress, os.Stderr)
+		} else {
+			bar = ShowProgress(progress, os.Stderr)
+		}
+	}
+	notifyStatus(func() { progress.Print(log.Writer()) })
+	notifyPause(func() {
+		if progress.TogglePause() {
+			infof("Paused, send SIGUSR2 again to resume")
+		} else {
+			infof("Resumed")
+		}
+	})
+	if jsonLog && logLevel >= storage.LogInfo {
+		logEvent("start", map[string]interface{}{
+			"verb":        verb,
+			"bucket":      options.Bucket,
+			"prefix":      options.Prefix,
+			"concurrency": options.Concurrency,
+		})
+	}
+	// 0 means there is no limit.
+	maxErrors := int64(1)
+	switch {
+	case options.Continue:
+		maxErrors = 0
+	case options.MaxErrors > 0:
+		maxErrors = options.MaxErrors
+	}
+	copyOptions := storage.CopyOptions{
+		Concurrency:   options.Concurrency,
+		MaxErrors:     maxErrors,
+		Policy:        policy,
+		Progress:      progress,
+		Manifest:      manifest,
+		PipeCommand:   options.Pipe,
+		UnpipeCommand: options.Unpipe,
+		Observer:      transferObserver{},
+	}
+	stats := storage.CopyItems(ctx, stop, dst, items, copyOptions)
+	// Unless the transfer has been interrupted or aborted,
+	// all items have been received and the listing has ended.
+	var listingErr error
+	if stop.Err() == nil && !(maxErrors > 0 && stats.Failed >= maxErrors) {
+		if listingErr = <-listErr; listingErr != nil {
+			log.Printf("Not all files have been listed: %s", listingErr)
+		}
+	}
+	if watched != nil && stop.Err() == nil && !(maxErrors > 0 && stats.Failed >= maxErrors) {
+		state := progress.State()
+		logSummary(stats, state.Transferred, state.Elapsed)
+		infof("Watching %s for changes, press Ctrl-C to stop...", options.Remainder[0])
+		// A single failure shouldn't stop the watch.
+		copyOptions.MaxErrors = 0
+		watched = filterItems(watched)
+		stats = storage.CopyItems(ctx, stop, dst, watched, copyOptions)
+	}
+	if bar != nil {
+		bar.Stop()
+	}
+	state := progress.State()
+	if manifest != nil {
+		if err := manifest.Close(); err != nil {
+			log.Printf("Could not write manifest: %s", err)
+		}
+	}
+	if run != nil {
+		run.SetAttr("s3put.transferred", stats.Transferred)
+		run.SetAttr("s3put.skipped", stats.Skipped)
+		run.SetAttr("s3put.failed", stats.Failed)
+		var err error
+		switch {
+		case stop.Err() != nil:
+			err = errors.New("Interrupted")
+		case listingErr != nil:
+			err = listingErr
+		case stats.Failed > 0:
+			err = fmt.Errorf("%d files failed", stats.Failed)
+		}
+		run.End(err)
+		tracer.Close()
+	}
+	if hooks != nil {
+		hooks.Finish(stats, state.Transferred, state.Elapsed, stop.Err() != nil)
+	}
+	if options.SlackWebhook != "" {
+		target := options.Bucket
+		if options.Prefix != "" {
+			target = strings.TrimSuffix(target, "/") + "/" + strings.TrimPrefix(options.Prefix, "/")
+		}
+		msg := slackMessage(verb, target, stats, state.Transferred, state.Elapsed, stop.Err() != nil)
+		if err := NotifySlack(options.SlackWebhook, msg); err != nil {
+			log.Printf("Could not notify Slack: %s", err)
+		}
+	}
+	logSummary(stats, state.Transferred, state.Elapsed)
+	if options.SummaryJSON != "" {
+		summary := progress.Summary()
+		summary.Interrupted = stop.Err() != nil
+		if err := WriteSummary(options.SummaryJSON, summary); err != nil {
+			exitf(ExitError, "Could not write summary: %s", err)
+		}
+	}
+	if options.SaveFailed != "" {
+		path, err := filepath.Abs(options.Remainder[0])
+		if err != nil {
+			exitf(ExitError, "Could not save failed files: %s", err)
+		}
+		run := &FailedRun{Verb: verb, Bucket: options.Bucket, Prefix: options.Prefix, Path: path}
+		for _, f := range progress.Summary().Failures {
+			run.Keys = append(run.Keys, f.Key)
+		}
+		if err := WriteFailedRun(options.SaveFailed, run); err != nil {
+			exitf(ExitError, "Could not save failed files: %s", err)
+		}
+	}
+	if copyOptions.MaxErrors > 0 && stats.Failed >= copyOptions.MaxErrors {
+		if options.MaxErrors > 0 {
+			exitf(ExitAborted, "Aborted, %d files have failed.", stats.Failed)
+		}
+		exitf(ExitAborted, "Aborted.")
+	}
+	if stop.Err() != nil {
+		if ctx.Err() == nil {
+			exitf(ExitAborted, "Interrupted.")
+		}
+		// Incomplete multipart uploads to S3 and resumable uploads
+		// to GCS are kept and continued by the next run.
+		exitf(ExitAborted, "Interrupted, rerun to resume aborted uploads.")
 	}
-	CopyItems(dst, items, options.Concurrency, options.Continue)
+	if listingErr != nil {
+		os.Exit(ExitError)
+	}
+	if stats.Failed > 0 {
+		os.Exit(ExitPartial)
+	}
+}
+
+// filterItems drops the items that don't match the filters given
+// on the command line.
+func filterItems(items <-chan *storage.Item) <-chan *storage.Item {
+	if len(filter) > 0 {
+		items = storage.FilterItems(items, storage.MatchPath(filter))
+	}
+	if len(options.FilterRegex) > 0 || len(options.ExcludeRegex) > 0 {
+		items = storage.FilterItems(items, storage.MatchPath(regexFilter))
+	}
+	if sizeRange != (storage.SizeRange{}) {
+		items = storage.FilterItems(items, sizeRange.MatchItem)
+	}
+	if timeRange != (storage.TimeRange{}) {
+		items = storage.FilterItems(items, timeRange.MatchItem)
+	}
+	return items
 }
 
-type HeaderPatchRoundTripper struct {
-	http.RoundTripper
-	Headers http.Header
+// Login saves keys in the keyring of the operating system under the
+// profile given with --profile or $AWS_PROFILE (or `default`).
+// Keys not given with -k and -s are asked for.
+func Login() {
+	profile := options.Profile
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	keys := storage.AWSKeys{AccessKey: options.AccessKey, SecretKey: options.SecretKey}
+	if keys.AccessKey == "" || keys.SecretKey == "" {
+		var err error
+		keys, err = promptKeys(os.Stdin, os.Stderr, keys)
+		if err != nil {
+			exitf(ExitConfig, "Could not read keys: %s", err)
+		}
+	}
+	err := storage.SaveKeyringKeys(profile, keys)
+	if err != nil {
+		exitf(ExitError, "Could not save keys in keyring: %s", err)
+	}
+	log.Printf("Saved keys of profile %s in keyring", profile)
+}
+
+// runDaemon runs the jobs in the config file on their schedules
+// until s3put is interrupted.
+func runDaemon() {
+	var args []string
+	if options.Config != "" {
+		path, err := filepath.Abs(options.Config)
+		if err != nil {
+			exitf(ExitConfig, "Could not load config: %s", err)
+		}
+		args = []string{"--config", path}
+	}
+	abort, stop := interruptContexts()
+	d, err := NewDaemon(abort, stop, jobs, args)
+	if err != nil {
+		exitf(ExitError, "Could not start daemon: %s", err)
+	}
+	if options.APIAddr != "" {
+		if err := d.ServeAPI(options.APIAddr); err != nil {
+			exitf(ExitConfig, "Could not serve API: %s", err)
+		}
+	}
+	notifyStatus(func() { d.PrintStatus(log.Writer()) })
+	infof("Scheduled %d jobs", len(d.Jobs))
+	d.Run()
+}
+
+// configureS3Storage applies the S3-specific options to s.
+func configureS3Storage(s *storage.S3Storage) {
+	var err error
+	s.Client = httpClient
+	s.VirtualHosted = options.VirtualHosted
+	s.Credentials = awsCredentials
+	s.ACL = s3.ACL(options.ACL)
+	s.VersionId = options.VersionId
+	s.AsOf = asOf
+	s.TagFilter, err = storage.ParseTagFilter(options.TagFilter)
+	if err != nil {
+		exitf(ExitConfig, "Invalid --tag: %s", err)
+	}
+	s.CacheControl = options.CacheControl
+	s.CacheControlRules, err = storage.ParsePatternRules(options.CacheRules)
+	if err != nil {
+		exitf(ExitConfig, "Invalid --cache-control-rule: %s", err)
+	}
+	s.Header, err = storage.ParseHeaders(options.Header)
+	if err != nil {
+		exitf(ExitConfig, "Invalid --header: %s", err)
+	}
+	s.Gzip = options.Gzip || len(options.GzipPatterns) > 0
+	s.GzipPatterns = options.GzipPatterns
+	s.KeepCompressed = options.KeepGzip
+	s.ContentDisposition = options.Disposition
+	s.ContentType = options.ContentType
+	if options.Expires != "" {
+		s.Expires, err = storage.ParseFutureTime(options.Expires, time.Now())
+		if err != nil {
+			exitf(ExitConfig, "Invalid --expires: %s", err)
+		}
+	}
+	s.Metadata, err = storage.ParseMetadata(options.Metadata)
+	if err != nil {
+		exitf(ExitConfig, "Invalid --metadata: %s", err)
+	}
+	s.StorageClass = options.StorageClass
+	s.SSEKMSKeyId = options.SSEKMSKeyId
+	s.RestoreDays = options.RestoreDays
+	s.RestoreTier = options.RestoreTier
+	s.SSECustomerKey, err = storage.LoadSSECustomerKey(options.SSECKeyFile)
+	if err != nil {
+		exitf(ExitConfig, "Could not load SSE-C key: %s", err)
+	}
+}
+
+// configureGCSStorage applies the options supported by the
+// JSON API of Google Cloud Storage to s.
+func configureGCSStorage(s *storage.GCSStorage) {
+	var err error
+	// Buckets with uniform bucket-level access reject object ACLs,
+	// so the default ACL is only applied if asked for.
+	if aclGiven {
+		s.ACL = options.ACL
+	}
+	s.CacheControl = options.CacheControl
+	s.ContentType = options.ContentType
+	s.Metadata, err = storage.ParseMetadata(options.Metadata)
+	if err != nil {
+		exitf(ExitConfig, "Invalid --metadata: %s", err)
+	}
+}
+
+// applyRemote takes the options defined by remote unless they are given
+// on the command line. p is appended to the prefix. Lists of rules and
+// patterns are added to those on the command line.
+func applyRemote(remote *Remote, p string) {
+	options.Bucket = remote.Bucket
+	if !flagGiven("-p") && !flagGiven("--prefix") {
+		options.Prefix = remote.Prefix
+	}
+	if p != "" {
+		options.Prefix = path.Join(options.Prefix, p)
+	}
+	if options.Endpoint == "" {
+		options.Endpoint = remote.Endpoint
+	}
+	if options.Region == "" {
+		options.Region = remote.Region
+	}
+	if options.Profile == "" {
+		options.Profile = remote.Profile
+	}
+	if options.Credentials == "" {
+		options.Credentials = remote.Credentials
+	}
+	if options.RoleArn == "" {
+		options.RoleArn = remote.RoleArn
+	}
+	if remote.Concurrency > 0 && !flagGiven("-c") && !flagGiven("--concurrency") {
+		options.Concurrency = remote.Concurrency
+	}
+	if options.CacheControl == "" {
+		options.CacheControl = remote.CacheControl
+	}
+	// Rules given on the command line come first, so they win.
+	options.CacheRules = append(options.CacheRules, remote.CacheControlRules...)
+	if remote.ACL != "" && !aclGiven {
+		options.ACL = remote.ACL
+		aclGiven = true
+	}
+	if options.StorageClass == "" {
+		options.StorageClass = remote.StorageClass
+	}
+	remoteFilter = remote.Filter()
+}
+
+// flagGiven reports whether flag has been passed on the command line.
+func flagGiven(flag string) bool {
+	for _, arg := range os.Args[1:] {
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// requireS3Storage exits if feature needs an S3 or GCS bucket
+// and s is not one.
+func requireS3Storage(s *storage.S3Storage, feature string) {
+	if s == nil {
+		exitf(ExitConfig, "%s is only supported for S3 and GCS buckets", feature)
+	}
+}
+
+func hasAnyPrefix(s string, prefixes ...string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
 }
 
-func (hprt *HeaderPatchRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
-	for h, vs := range hprt.Headers {
-		for _, v := range vs {
-			r.Header.Add(h, v)
+func validACL(acl s3.ACL) bool {
+	for _, a := range storage.CannedACLs {
+		if a == acl {
+			return true
 		}
 	}
-	return hprt.RoundTripper.RoundTrip(r)
+	return false
 }
 
-func monkeyPatchDefaultTransport() {
-	http.DefaultTransport = &HeaderPatchRoundTripper{
-		RoundTripper: http.DefaultTransport,
-		Headers: http.Header{
-			"Cache-Control": []string{options.CacheControl},
-		},
+func aclNames() []string {
+	var names []string
+	for _, a := range storage.CannedACLs {
+		names = append(names, string(a))
 	}
+	return names
 }
 
 const (
-	helpTemplate = "\xffUsage: {{.Name}} [global options] <get|put> <files...>\n" +
+	helpTemplate = "\xffUsage: {{.Name}} [global options] <get|put|check|versions|undelete|restore|select|login|retry-failed|daemon> [<remote>:<path>] <files...>\n" +
 		"\n" +
 		"Global options:\xff" +
 		"{{range .Flags}}" +
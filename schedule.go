@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a cron-like schedule with the fields minute, hour, day
+// of month, month and day of week (0 is Sunday), e.g. `30 2 * * 1-5`
+// for 2:30 on weekdays. Fields are `*`, numbers, ranges (`1-5`) and
+// steps (`*/15`, `0-30/10`), separated by commas. Like with cron, a
+// day matches if either the day of month or the day of week does when
+// both are restricted. `@hourly`, `@daily`, `@weekly` and `@monthly`
+// are shorthands.
+type Schedule struct {
+	spec string
+	// The bits of the fields are set for the values that match.
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set if the field starts with `*`.
+	domAny, dowAny bool
+}
+
+var scheduleShorthands = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+func ParseSchedule(spec string) (*Schedule, error) {
+	expanded := spec
+	if s, ok := scheduleShorthands[spec]; ok {
+		expanded = s
+	}
+	fields := strings.Fields(expanded)
+	if len(fields) != 5 {
+		return nil, errors.New("Schedule must have 5 fields (minute hour day month weekday)")
+	}
+	s := &Schedule{
+		spec:   spec,
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	ranges := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		// 7 is Sunday, too.
+		{&s.dow, 0, 7},
+	}
+	for i, r := range ranges {
+		bits, err := parseScheduleField(fields[i], r.min, r.max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid field %s: %s", fields[i], err)
+		}
+		*r.bits = bits
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.New("Invalid step")
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, errors.New("Not a number")
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, errors.New("Not a number")
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("Out of range %d-%d", min, max)
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// Next returns the first time after t that matches the schedule, or
+// the zero time if there is none (e.g. for the 31st of February).
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Schedules that match at all do so within 4 years,
+	// because of the 29th of February.
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
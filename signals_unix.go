@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyStatus calls report whenever s3put receives SIGUSR1,
+// e.g. to check on a long-running backup with `pkill -USR1 s3put`.
+func notifyStatus(report func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			report()
+		}
+	}()
+}
+
+// notifyPause calls toggle whenever s3put receives SIGUSR2.
+func notifyPause(toggle func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			toggle()
+		}
+	}()
+}
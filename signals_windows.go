@@ -0,0 +1,7 @@
+package main
+
+// notifyStatus does nothing, as there is no SIGUSR1 on Windows.
+func notifyStatus(report func()) {}
+
+// notifyPause does nothing, as there is no SIGUSR2 on Windows.
+func notifyPause(toggle func()) {}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// slackMessage describes the outcome of a run in a line, like
+//
+//	:white_check_mark: s3put put to some-bucket/www: 120 transferred, ... (1.2 GiB in 5m30s)
+func slackMessage(verb, target string, stats storage.TransferStats, transferred int64, d time.Duration, interrupted bool) string {
+	icon, outcome := ":white_check_mark:", ""
+	switch {
+	case interrupted:
+		icon, outcome = ":warning:", " interrupted"
+	case stats.Failed > 0:
+		icon, outcome = ":x:", " failed"
+	}
+	direction := "to"
+	if verb == "get" {
+		direction = "from"
+	}
+	return fmt.Sprintf("%s s3put %s %s %s%s: %s (%s in %s)",
+		icon, verb, direction, target, outcome, stats, storage.FormatSize(transferred), d.Round(time.Second))
+}
+
+// NotifySlack posts text to a Slack incoming webhook.
+func NotifySlack(webhook, text string) error {
+	data, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	// The URL of the webhook is a secret, so it must neither
+	// be logged with -vv nor end up in error messages.
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+		Timeout:   30 * time.Second,
+	}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(data))
+	if uerr, ok := err.(*url.Error); ok {
+		return uerr.Err
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return nil
+}
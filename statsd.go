@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// StatsD sends metrics of the transfers to a StatsD server or
+// a Datadog agent. Metrics are sent over UDP, so they are lost
+// rather than slowing down the transfers if the server is down.
+type StatsD struct {
+	conn net.Conn
+}
+
+func DialStatsD(addr string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{conn}, nil
+}
+
+// Transfer sends the metrics of the transfer of item, which took d.
+func (s *StatsD) Transfer(item *storage.Item, skipped bool, err error, d time.Duration) {
+	switch {
+	case err != nil:
+		s.send("s3put.objects.failed:1|c")
+	case skipped:
+		s.send("s3put.objects.skipped:1|c")
+	default:
+		s.send(
+			"s3put.objects.transferred:1|c",
+			fmt.Sprintf("s3put.bytes:%d|c", item.Size),
+			fmt.Sprintf("s3put.transfer.duration:%d|ms", d/time.Millisecond),
+		)
+	}
+}
+
+// send sends metrics in a single packet.
+func (s *StatsD) send(metrics ...string) {
+	s.conn.Write([]byte(strings.Join(metrics, "\n")))
+}
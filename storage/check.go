@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/amz.v1/s3"
+)
+
+// Check compares the files of local with the objects of remote by size
+// and, unless sizeOnly is set, checksum and prints a report of all
+// differences to w. It returns false if any discrepancy has been found.
+func Check(ctx context.Context, w io.Writer, local *LocalStorage, remote *S3Storage, sizeOnly bool) (bool, error) {
+	objects, err := remote.ListObjects(ctx)
+	if err != nil {
+		return false, err
+	}
+	remoteByPath := map[string]s3.Key{}
+	for _, obj := range objects {
+		remoteByPath[relativePath(obj.Key, remote.prefix)] = obj
+	}
+
+	ok := true
+	items, listErr := local.ListFiles(ctx)
+	for item := range items {
+		path := filepath.ToSlash(relativePath(item.Path, item.Prefix))
+		obj, found := remoteByPath[path]
+		if !found {
+			item.Close()
+			fmt.Fprintf(w, "missing:  %s\n", path)
+			ok = false
+			continue
+		}
+		delete(remoteByPath, path)
+		remoteSize, remoteETag := obj.Size, normalizeETag(obj.ETag)
+		if remoteSize != item.Size || remote.shouldGzip(item) {
+			// Compressed objects are compared by the size and
+			// checksum of their content, which only a HEAD
+			// request returns.
+			uncompressed, err := remote.uncompressedItem(ctx, obj.Key, &Item{Size: remoteSize, ETag: remoteETag})
+			if err != nil {
+				item.Close()
+				log.Printf("Could not look up %s: %s", obj.Key, err)
+				ok = false
+				continue
+			}
+			remoteSize, remoteETag = uncompressed.Size, uncompressed.ETag
+		}
+		if remoteSize != item.Size {
+			item.Close()
+			fmt.Fprintf(w, "mismatch: %s (size: local %d, remote %d)\n", path, item.Size, remoteSize)
+			ok = false
+			continue
+		}
+		if sizeOnly {
+			item.Close()
+			continue
+		}
+		etag, err := localETag(item, remoteETag)
+		item.Close()
+		if err != nil {
+			log.Printf("Could not checksum %s: %s", item.Path, err)
+			ok = false
+			continue
+		}
+		if etag == "" {
+			fmt.Fprintf(w, "unverifiable: %s (multipart upload with unknown part size)\n", path)
+			continue
+		}
+		if etag != remoteETag {
+			fmt.Fprintf(w, "mismatch: %s (checksum: local %s, remote %s)\n", path, etag, remoteETag)
+			ok = false
+		}
+	}
+	if err := <-listErr; err != nil {
+		return false, err
+	}
+
+	extra := make([]string, 0, len(remoteByPath))
+	for path := range remoteByPath {
+		extra = append(extra, path)
+	}
+	sort.Strings(extra)
+	for _, path := range extra {
+		fmt.Fprintf(w, "extra:    %s\n", path)
+		ok = false
+	}
+	return ok, nil
+}
+
+// localETag calculates the ETag item would have on S3. The format
+// of remoteETag decides whether a multipart ETag is calculated. As
+// the part size of multipart uploads isn't recorded, all part sizes
+// that result in the number of parts of remoteETag are tried. If none
+// of them matches, the ETag can't be calculated and "" is returned.
+func localETag(item *Item, remoteETag string) (string, error) {
+	if i := strings.LastIndex(remoteETag, "-"); i >= 0 {
+		parts, err := strconv.Atoi(remoteETag[i+1:])
+		ra, isReaderAt := item.ReadCloser.(io.ReaderAt)
+		if err != nil || !isReaderAt {
+			return "", nil
+		}
+		for _, partSize := range partSizes(item.Size, parts) {
+			etag, err := multipartETag(ra, item.Size, partSize)
+			if err != nil || etag == remoteETag {
+				return etag, err
+			}
+		}
+		return "", nil
+	}
+	h := md5.New()
+	_, err := io.Copy(h, item)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func relativePath(path, prefix string) string {
+	return strings.Trim(strings.TrimPrefix(path, prefix), "/")
+}
@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// multipartETag calculates the ETag S3 assigns to an object that has
+// been uploaded in parts of partSize bytes: The MD5 of the concatenated
+// binary MD5s of all parts, followed by the number of parts.
+func multipartETag(r io.ReaderAt, size, partSize int64) (string, error) {
+	all := md5.New()
+	n := 0
+	for offset := int64(0); offset < size; offset += partSize {
+		h := md5.New()
+		_, err := io.Copy(h, io.NewSectionReader(r, offset, partSize))
+		if err != nil {
+			return "", err
+		}
+		all.Write(h.Sum(nil))
+		n++
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(all.Sum(nil)), n), nil
+}
+
+// commonPartSizes are the part sizes of s3put and other popular tools,
+// e.g. 8 MiB for the AWS CLI and 5 MiB, the smallest S3 allows.
+var commonPartSizes = []int64{multipartPartSize, 8 << 20, 5 << 20, 15 << 20, 64 << 20}
+
+// partSizes returns the part sizes with which an object of size bytes
+// could have been uploaded in n parts: the common ones and the size of
+// n equal parts rounded up to a MiB.
+func partSizes(size int64, n int) []int64 {
+	if n <= 0 {
+		return nil
+	}
+	const mib = 1 << 20
+	equal := (size + int64(n) - 1) / int64(n)
+	equal = (equal + mib - 1) / mib * mib
+	var sizes []int64
+	for _, partSize := range append(commonPartSizes, equal) {
+		if partSize <= 0 || (size+partSize-1)/partSize != int64(n) {
+			continue
+		}
+		known := false
+		for _, s := range sizes {
+			known = known || s == partSize
+		}
+		if !known {
+			sizes = append(sizes, partSize)
+		}
+	}
+	return sizes
+}
+
+// normalizeETag strips the quotes S3 puts around ETags.
+func normalizeETag(etag string) string {
+	return strings.ToLower(strings.Trim(etag, `"`))
+}
+
+// matchesETag reports whether the content of item has the given
+// ETag. The item is rewound afterwards, so items that can't
+// seek never match.
+func matchesETag(item *Item, etag string) (bool, error) {
+	rs, ok := item.ReadCloser.(io.Seeker)
+	if !ok {
+		return false, nil
+	}
+	local, err := localETag(item, etag)
+	if err != nil {
+		return false, err
+	}
+	_, err = rs.Seek(0, io.SeekStart)
+	return local == etag, err
+}
+
+// fileMatchesETag reports whether the file at path has the given ETag.
+func fileMatchesETag(path string, size int64, etag string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	local, err := localETag(&Item{Size: size, ReadCloser: f}, etag)
+	return local == etag, err
+}
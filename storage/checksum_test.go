@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type readerAtCloser struct {
+	*bytes.Reader
+}
+
+func (readerAtCloser) Close() error { return nil }
+
+func TestLocalETagPartSizes(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 11<<20/16)
+	item := &Item{Size: int64(len(data)), ReadCloser: readerAtCloser{bytes.NewReader(data)}}
+	for _, partSize := range []int64{multipartPartSize, 8 << 20, 6 << 20, 5 << 20} {
+		want, err := multipartETag(bytes.NewReader(data), item.Size, partSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := localETag(item, want); err != nil || got != want {
+			t.Errorf("Part size %d: got %q, %v, want %q", partSize, got, err, want)
+		}
+	}
+	// 2 parts of 7 MiB can't be told apart from other part sizes.
+	other, _ := multipartETag(bytes.NewReader(data), item.Size, 7<<20)
+	if got, _ := localETag(item, other); got != "" {
+		t.Errorf("Got %q for an unknown part size", got)
+	}
+}
+
+func TestFileMatchesETag(t *testing.T) {
+	f, err := ioutil.TempFile("", "s3put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("hello")
+	f.Close()
+	for etag, want := range map[string]bool{
+		"5d41402abc4b2a76b9719d911017c592":   true,
+		"5d41402abc4b2a76b9719d911017c593":   false,
+		"62109206880d38a4010a98e11243924a-1": true,
+		"62109206880d38a4010a98e11243924a-2": false,
+	} {
+		if got, err := fileMatchesETag(f.Name(), 5, etag); err != nil || got != want {
+			t.Errorf("%s: got %v, %v, want %v", etag, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProcessCredentials returns credentials printed by command, as
+// configured with `credential_process` in the AWS config. The command
+// is run again when the keys expire. Its output is JSON like:
+//
+//	{"Version": 1, "AccessKeyId": "...", "SecretAccessKey": "...",
+//	 "SessionToken": "...", "Expiration": "2017-01-01T12:00:00Z"}
+//
+// Keys without an expiration are used for the whole run.
+func ProcessCredentials(command string) *AWSCredentials {
+	return &AWSCredentials{fetch: func() (AWSKeys, time.Time, error) {
+		cmd := ShellCommand(command)
+		// Helpers may ask for a password or MFA code.
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return AWSKeys{}, time.Time{}, fmt.Errorf("credential_process %q failed: %s", command, err)
+		}
+		var result struct {
+			Version         int
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      string
+		}
+		err = json.Unmarshal(out, &result)
+		if err != nil {
+			return AWSKeys{}, time.Time{}, fmt.Errorf("Invalid output of credential_process: %s", err)
+		}
+		if result.Version != 1 || result.AccessKeyId == "" || result.SecretAccessKey == "" {
+			return AWSKeys{}, time.Time{}, errors.New("Invalid output of credential_process: needs Version 1, AccessKeyId and SecretAccessKey")
+		}
+		var expiry time.Time
+		if exp := strings.TrimSpace(result.Expiration); exp != "" {
+			expiry, err = time.Parse(time.RFC3339, exp)
+			if err != nil {
+				return AWSKeys{}, time.Time{}, fmt.Errorf("Invalid expiration in output of credential_process: %s", err)
+			}
+		}
+		return AWSKeys{
+			AccessKey:    result.AccessKeyId,
+			SecretKey:    result.SecretAccessKey,
+			SessionToken: result.SessionToken,
+		}, expiry, nil
+	}}
+}
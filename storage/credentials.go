@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AWSKeys are the keys requests to S3 are signed with.
+// SessionToken is only set for temporary keys.
+type AWSKeys struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// AWSCredentials provides the keys to sign requests with and
+// refreshes temporary keys before they expire.
+type AWSCredentials struct {
+	// fetch requests new keys. A zero expiry means they don't expire.
+	fetch func() (AWSKeys, time.Time, error)
+
+	mu     sync.Mutex
+	keys   *AWSKeys
+	expiry time.Time
+}
+
+// StaticAWSCredentials returns credentials that always provide keys.
+func StaticAWSCredentials(keys AWSKeys) *AWSCredentials {
+	return &AWSCredentials{keys: &keys}
+}
+
+// Get returns valid keys.
+func (c *AWSCredentials) Get() (AWSKeys, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.keys != nil && (c.expiry.IsZero() || time.Now().Add(5*time.Minute).Before(c.expiry)) {
+		return *c.keys, nil
+	}
+	keys, expiry, err := c.fetch()
+	if err != nil {
+		return AWSKeys{}, fmt.Errorf("Could not get AWS keys: %s", err)
+	}
+	c.keys, c.expiry = &keys, expiry
+	return keys, nil
+}
+
+// LookupAWSCredentials finds the keys to use if none are given on the
+// command line, in the same order as the AWS CLI: The keys of profile,
+// if given, else those in the environment, else those of the role in
+// $AWS_ROLE_ARN assumed with the token in $AWS_WEB_IDENTITY_TOKEN_FILE,
+// else those of the profile named in $AWS_PROFILE or the default
+// profile (saved in the keyring by `login` or in the AWS config),
+// else those of the ECS task's or EC2 instance's role.
+// If there are none, nil is returned. Web identity tokens are
+// exchanged for keys through STS with client.
+func LookupAWSCredentials(profile string, client *http.Client) (*AWSCredentials, error) {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+		keys := AWSKeys{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		if keys.AccessKey != "" || keys.SecretKey != "" {
+			return StaticAWSCredentials(keys), nil
+		}
+		if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+			roleArn := os.Getenv("AWS_ROLE_ARN")
+			if roleArn == "" {
+				return nil, errors.New("$AWS_WEB_IDENTITY_TOKEN_FILE is set, but $AWS_ROLE_ARN is not")
+			}
+			return WebIdentityCredentials(client, tokenFile, roleArn, os.Getenv("AWS_ROLE_SESSION_NAME")), nil
+		}
+	}
+	name := profile
+	if name == "" {
+		name = "default"
+	}
+	if creds, err := keyringCredentials(name); err != nil || creds != nil {
+		return creds, err
+	}
+	if profile != "" {
+		return loadAWSProfile(profile, true)
+	}
+	creds, err := loadAWSProfile("default", false)
+	if err != nil || creds != nil {
+		return creds, err
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		return containerCredentials(uri), nil
+	}
+	return instanceCredentials(), nil
+}
+
+// loadAWSProfile reads the keys of profile from the shared credentials
+// file and, failing that, the config file. Instead of keys, a profile
+// can name a program printing them in `credential_process`. If the
+// profile exists in neither file, it is an error only if required is
+// set, otherwise nil is returned.
+func loadAWSProfile(profile string, required bool) (*AWSCredentials, error) {
+	credentialsFile := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if credentialsFile == "" {
+		credentialsFile = filepath.Join(awsConfigDir(), "credentials")
+	}
+	configFile := os.Getenv("AWS_CONFIG_FILE")
+	if configFile == "" {
+		configFile = filepath.Join(awsConfigDir(), "config")
+	}
+
+	// Profiles other than the default one are prefixed
+	// with `profile` in the config file.
+	configSection := "profile " + profile
+	if profile == "default" {
+		configSection = profile
+	}
+	for _, source := range []struct{ file, section string }{
+		{credentialsFile, profile},
+		{configFile, configSection},
+	} {
+		sections, err := readINIFile(source.file)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read %s: %s", source.file, err)
+		}
+		values := sections[source.section]
+		if values["aws_access_key_id"] != "" {
+			return StaticAWSCredentials(AWSKeys{
+				AccessKey:    values["aws_access_key_id"],
+				SecretKey:    values["aws_secret_access_key"],
+				SessionToken: values["aws_session_token"],
+			}), nil
+		}
+		if command := values["credential_process"]; command != "" {
+			return ProcessCredentials(command), nil
+		}
+	}
+	if required {
+		return nil, fmt.Errorf("No keys found for profile %s", profile)
+	}
+	return nil, nil
+}
+
+func awsConfigDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".aws"
+	}
+	return filepath.Join(home, ".aws")
+}
+
+// readINIFile parses the sections of the INI file at path into maps of
+// their keys and values. A missing file has no sections.
+func readINIFile(path string) (map[string]map[string]string, error) {
+	sections := map[string]map[string]string{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return sections, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var section map[string]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			name := strings.Join(strings.Fields(line[1:len(line)-1]), " ")
+			section = sections[name]
+			if section == nil {
+				section = map[string]string{}
+				sections[name] = section
+			}
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 || section == nil {
+			continue
+		}
+		section[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i+1:])
+	}
+	return sections, scanner.Err()
+}
@@ -0,0 +1,16 @@
+package storage
+
+import (
+	"sync/atomic"
+)
+
+// reportReads makes reads from the content of item call onRead with
+// the number of bytes read so far.
+func reportReads(item *Item, onRead func(item *Item, read int64)) {
+	var read int64
+	hookReads(item, readHooks{
+		read: func(b []byte, off int64, ordered bool) {
+			onRead(item, atomic.AddInt64(&read, int64(len(b))))
+		},
+	})
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FilterRule includes or excludes all paths matching a shell glob.
+// Patterns work like rsync's: A pattern without a slash is matched
+// against every path component, a pattern starting with a slash is
+// anchored at the root of the transfer and a pattern ending with a
+// slash only matches directories.
+type FilterRule struct {
+	Include bool
+	Pattern string
+}
+
+// Filter is a list of rules. The first matching rule decides whether
+// a path is transferred. Paths not matched by any rule are transferred.
+type Filter []FilterRule
+
+func (f Filter) Match(relpath string) bool {
+	return f.match(relpath, false)
+}
+
+// MatchDir is like Match for directories.
+func (f Filter) MatchDir(relpath string) bool {
+	return f.match(relpath, true)
+}
+
+func (f Filter) match(relpath string, isDir bool) bool {
+	for _, rule := range f {
+		if rule.matches(relpath, isDir) {
+			return rule.Include
+		}
+	}
+	return true
+}
+
+func (r FilterRule) matches(relpath string, isDir bool) bool {
+	pattern := r.Pattern
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	anchored := strings.HasPrefix(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	components := strings.Split(strings.Trim(relpath, "/"), "/")
+	last := len(components)
+	if dirOnly && !isDir {
+		last--
+	}
+	// A path is matched if the pattern matches the path itself or
+	// any of its parent directories.
+	for end := 1; end <= last; end++ {
+		if matchComponents(pattern, components[:end], anchored) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchComponents(pattern string, components []string, anchored bool) bool {
+	if !anchored && !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, components[len(components)-1])
+		return ok
+	}
+	patternComponents := strings.Split(pattern, "/")
+	start := len(components) - 1
+	if anchored {
+		start = 0
+	}
+	for i := 0; i <= start; i++ {
+		if matchGlob(patternComponents, components[i:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches path components against pattern components,
+// where `**` matches any number of path components.
+func matchGlob(pattern, components []string) bool {
+	if len(pattern) == 0 {
+		return len(components) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(components); i++ {
+			if matchGlob(pattern[1:], components[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(components) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], components[0]); !ok {
+		return false
+	}
+	return matchGlob(pattern[1:], components[1:])
+}
+
+// ParseFilterArgs collects all --include and --exclude flags from args.
+// goptions keeps them in separate lists, which loses the order
+// between includes and excludes. The patterns of --include-from and
+// --exclude-from files are inserted at the position of the flag.
+func ParseFilterArgs(args []string) (Filter, error) {
+	var f Filter
+	for i := 0; i < len(args); i++ {
+		parts := strings.SplitN(args[i], "=", 2)
+		switch parts[0] {
+		case "--include", "--exclude", "--include-from", "--exclude-from":
+		default:
+			continue
+		}
+		if len(parts) == 1 {
+			if i+1 >= len(args) {
+				break
+			}
+			i++
+			parts = append(parts, args[i])
+		}
+		include := strings.HasPrefix(parts[0], "--include")
+		if !strings.HasSuffix(parts[0], "-from") {
+			f = append(f, FilterRule{include, parts[1]})
+			continue
+		}
+		patterns, err := readPatternFile(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		for _, pattern := range patterns {
+			f = append(f, FilterRule{include, pattern})
+		}
+	}
+	return f, nil
+}
+
+// readPatternFile reads one pattern per line, skipping
+// empty lines and comments starting with `#`.
+func readPatternFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	return patterns, scanner.Err()
+}
+
+// Matcher decides whether the item at a relative,
+// slash-separated path is transferred.
+type Matcher interface {
+	Match(relpath string) bool
+}
+
+// RegexFilter matches paths that match any of the Include expressions
+// (or all paths if there are none) but none of the Exclude expressions.
+type RegexFilter struct {
+	Include []*regexp.Regexp
+	Exclude []*regexp.Regexp
+}
+
+func NewRegexFilter(include, exclude []string) (*RegexFilter, error) {
+	f := &RegexFilter{}
+	for _, expr := range include {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		f.Include = append(f.Include, re)
+	}
+	for _, expr := range exclude {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		f.Exclude = append(f.Exclude, re)
+	}
+	return f, nil
+}
+
+func (f *RegexFilter) Match(relpath string) bool {
+	for _, re := range f.Exclude {
+		if re.MatchString(relpath) {
+			return false
+		}
+	}
+	for _, re := range f.Include {
+		if re.MatchString(relpath) {
+			return true
+		}
+	}
+	return len(f.Include) == 0
+}
+
+// SizeRange matches items of at least Min and, unless Max
+// is 0, at most Max bytes.
+type SizeRange struct {
+	Min, Max int64
+}
+
+func (r SizeRange) MatchItem(item *Item) bool {
+	return item.Size >= r.Min && (r.Max == 0 || item.Size <= r.Max)
+}
+
+// TimeRange matches items modified after After and before Before.
+// Zero times are not checked.
+type TimeRange struct {
+	After, Before time.Time
+}
+
+func (r TimeRange) MatchItem(item *Item) bool {
+	return (r.After.IsZero() || item.ModTime.After(r.After)) &&
+		(r.Before.IsZero() || item.ModTime.Before(r.Before))
+}
+
+// MatchPath matches items whose path relative to their prefix is matched by m.
+func MatchPath(m Matcher) func(item *Item) bool {
+	return func(item *Item) bool {
+		return m.Match(filepath.ToSlash(relativePath(item.Path, item.Prefix)))
+	}
+}
+
+// FilterItems drops all items that keep returns false for.
+func FilterItems(items <-chan *Item, keep func(item *Item) bool) <-chan *Item {
+	c := make(chan *Item)
+	go func() {
+		defer close(c)
+		for item := range items {
+			if !keep(item) {
+				item.Close()
+				continue
+			}
+			c <- item
+		}
+	}()
+	return c
+}
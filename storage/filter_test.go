@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func mustCompile(t *testing.T, exprs ...string) []*regexp.Regexp {
+	t.Helper()
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, re)
+	}
+	return res
+}
+
+func TestFilterRuleMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		// Patterns without a slash match any component.
+		{"*.log", "debug.log", false, true},
+		{"*.log", "logs/debug.log", false, true},
+		{"*.log", "debug.log.gz", false, false},
+		{"cache", "a/cache/b.txt", false, true},
+		// A leading slash anchors the pattern.
+		{"/build", "build/app.js", false, true},
+		{"/build", "src/build/app.js", false, false},
+		// Patterns with a slash match at any depth unless anchored.
+		{"src/*.go", "src/main.go", false, true},
+		{"src/*.go", "vendor/src/main.go", false, true},
+		{"src/*.go", "src/sub/main.go", false, false},
+		// A trailing slash only matches directories.
+		{"tmp/", "tmp", false, false},
+		{"tmp/", "tmp", true, true},
+		{"tmp/", "tmp/file", false, true},
+		// `**` matches any number of components.
+		{"/docs/**/*.md", "docs/README.md", false, true},
+		{"/docs/**/*.md", "docs/a/b/c.md", false, true},
+		{"/docs/**/*.md", "other/docs/a.md", false, false},
+		// Character classes and single characters.
+		{"file?.[ch]", "file1.c", false, true},
+		{"file?.[ch]", "file10.c", false, false},
+		{"*", "a b/ü.txt", false, true},
+	}
+	for _, test := range tests {
+		got := FilterRule{Pattern: test.pattern}.matches(test.path, test.isDir)
+		if got != test.want {
+			t.Errorf("%q matches %q (dir: %v) = %v, want %v", test.pattern, test.path, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestFilterFirstMatchWins(t *testing.T) {
+	f := Filter{
+		{Include: true, Pattern: "important.log"},
+		{Include: false, Pattern: "*.log"},
+		{Include: false, Pattern: "/secret/"},
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"important.log", true},
+		{"logs/important.log", true},
+		{"debug.log", false},
+		{"secret/key.pem", false},
+		{"public/secret/key.pem", true},
+		{"index.html", true},
+	}
+	for _, test := range tests {
+		if got := f.Match(test.path); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+	if f.MatchDir("secret") {
+		t.Error("MatchDir(secret) = true, want false")
+	}
+}
+
+func TestParseFilterArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	patterns := filepath.Join(dir, "patterns")
+	if err := ioutil.WriteFile(patterns, []byte("# comment\n*.tmp\n\n*.bak  \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-c", "5", "--include", "*.html", "--exclude=*", "--exclude-from", patterns, "--include-from=" + patterns, "put", "dist"}
+	got, err := ParseFilterArgs(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Filter{
+		{Include: true, Pattern: "*.html"},
+		{Include: false, Pattern: "*"},
+		{Include: false, Pattern: "*.tmp"},
+		{Include: false, Pattern: "*.bak"},
+		{Include: true, Pattern: "*.tmp"},
+		{Include: true, Pattern: "*.bak"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
+
+func TestRegexFilter(t *testing.T) {
+	f, err := NewRegexFilter([]string{`\.jpe?g$`, `^raw/`}, []string{`thumb`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"a.jpg", true},
+		{"b/c.jpeg", true},
+		{"raw/d.cr2", true},
+		{"thumb.jpg", false},
+		{"e.png", false},
+	}
+	for _, test := range tests {
+		if got := f.Match(test.path); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+	if _, err := NewRegexFilter([]string{"("}, nil); err == nil {
+		t.Error("Invalid expression was accepted")
+	}
+}
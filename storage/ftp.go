@@ -0,0 +1,603 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FTPStorage stores files on an FTP server. FTP connections can
+// only do one transfer at a time, so every concurrent transfer uses
+// its own connection. Idle connections are kept for reuse.
+type FTPStorage struct {
+	addr     string
+	user     string
+	password string
+	// tlsConfig is set for FTPS (explicit TLS).
+	tlsConfig *tls.Config
+	// base is the directory files are stored in.
+	base string
+	// RateLimiter, if set, limits the bandwidth of the data connections.
+	RateLimiter *RateLimiter
+
+	mu   sync.Mutex
+	idle []*ftpConn
+	// made holds the directories created by mkdirAll.
+	madeMu sync.Mutex
+	made   map[string]bool
+}
+
+// NewFTPStorage creates a storage for a URL like `ftp://host/dir`
+// or `ftps://host:2121/dir`. User and password in the URL take
+// precedence over the given ones. Without either, the anonymous
+// user is logged in.
+func NewFTPStorage(storageUrl, user, password, prefix string) (*FTPStorage, error) {
+	u, err := url.Parse(storageUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if user == "" {
+		user, password = "anonymous", "anonymous"
+	}
+	s := &FTPStorage{
+		addr:     u.Host,
+		user:     user,
+		password: password,
+		base:     path.Join("/", u.Path, prefix),
+		made:     map[string]bool{},
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	switch u.Scheme {
+	case "ftp":
+	case "ftps":
+		s.tlsConfig = &tls.Config{
+			ServerName: u.Hostname(),
+			// Most servers require data connections to resume
+			// the session of the control connection.
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+	default:
+		return nil, fmt.Errorf("Invalid FTP URL %s", u.Redacted())
+	}
+	// Fail early on wrong credentials.
+	c, err := s.conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s.release(c)
+	return s, nil
+}
+
+func (s *FTPStorage) ListFiles(ctx context.Context) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		conn, err := s.conn(ctx)
+		if err != nil {
+			return fmt.Errorf("Could not connect to %s: %s", s.addr, err)
+		}
+		stop := conn.abortOn(ctx)
+		var files []ftpEntry
+		dirs := []string{s.base}
+		for len(dirs) > 0 {
+			dir := dirs[0]
+			dirs = dirs[1:]
+			entries, err := conn.list(dir)
+			if err != nil {
+				stop()
+				conn.Close()
+				return fmt.Errorf("Could not list %s: %s", dir, err)
+			}
+			for _, entry := range entries {
+				switch entry.Type {
+				case "dir":
+					dirs = append(dirs, entry.Path)
+				case "file":
+					files = append(files, entry)
+				}
+			}
+		}
+		stop()
+		s.release(conn)
+
+		for _, file := range files {
+			file := file
+			item := &Item{
+				Prefix:  s.base,
+				Path:    file.Path,
+				Size:    file.Size,
+				ModTime: file.ModTime,
+				Open: func(ctx context.Context, item *Item) error {
+					item.ReadCloser = &ftpReader{ctx: ctx, storage: s, path: file.Path}
+					return nil
+				},
+			}
+			if !sendItem(ctx, c, item) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// StatFiles is ListFiles, as its items are only opened when read.
+func (s *FTPStorage) StatFiles(ctx context.Context) <-chan *Item {
+	items, _ := s.ListFiles(ctx)
+	return items
+}
+
+func (s *FTPStorage) PutFile(ctx context.Context, item *Item) error {
+	defer item.Close()
+	target := path.Join(s.base, filepath.ToSlash(strings.TrimPrefix(item.Path, item.Prefix)))
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	stop := conn.abortOn(ctx)
+	err = s.mkdirAll(conn, path.Dir(target))
+	if err == nil {
+		err = conn.store(target, contextReader{ctx, item})
+	}
+	stop()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s.release(conn)
+	return nil
+}
+
+// Stat looks up the file at path with SIZE and MDTM. FTP
+// servers don't provide checksums or content types.
+func (s *FTPStorage) Stat(ctx context.Context, p string) (*ItemInfo, error) {
+	target := path.Join(s.base, filepath.ToSlash(p))
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stop := conn.abortOn(ctx)
+	_, size, err := conn.cmd(213, "SIZE %s", target)
+	if perr, ok := err.(*textproto.Error); ok && perr.Code == 550 {
+		stop()
+		s.release(conn)
+		return nil, nil
+	}
+	var modify string
+	if err == nil {
+		_, modify, err = conn.cmd(213, "MDTM %s", target)
+	}
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.release(conn)
+	info := &ItemInfo{}
+	info.Size, err = strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid size of %s: %s", target, size)
+	}
+	// Fractions of seconds are optional.
+	info.ModTime, _ = time.Parse("20060102150405", strings.SplitN(modify, ".", 2)[0])
+	return info, nil
+}
+
+// mkdirAll creates dir and all its parents. Failures are ignored,
+// as most servers don't distinguish between failing and existing
+// directories. Uploading into a missing directory fails anyway.
+func (s *FTPStorage) mkdirAll(conn *ftpConn, dir string) error {
+	s.madeMu.Lock()
+	defer s.madeMu.Unlock()
+	var parents []string
+	for d := dir; d != "/" && d != "." && !s.made[d]; d = path.Dir(d) {
+		parents = append(parents, d)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		_, _, err := conn.cmd(2, "MKD %s", parents[i])
+		if _, isProtocolError := err.(*textproto.Error); err != nil && !isProtocolError {
+			return err
+		}
+		s.made[parents[i]] = true
+	}
+	return nil
+}
+
+// conn returns an idle connection or dials a new one.
+func (s *FTPStorage) conn(ctx context.Context) (*ftpConn, error) {
+	s.mu.Lock()
+	if len(s.idle) > 0 {
+		c := s.idle[len(s.idle)-1]
+		s.idle = s.idle[:len(s.idle)-1]
+		s.mu.Unlock()
+		c.limiter = s.RateLimiter
+		return c, nil
+	}
+	s.mu.Unlock()
+	c, err := dialFTP(ctx, s.addr, s.tlsConfig, s.user, s.password)
+	if err != nil {
+		return nil, err
+	}
+	c.limiter = s.RateLimiter
+	return c, nil
+}
+
+// release makes a connection available for reuse, unless
+// it has been aborted.
+func (s *FTPStorage) release(c *ftpConn) {
+	if atomic.LoadInt32(&c.aborted) != 0 {
+		c.Close()
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idle = append(s.idle, c)
+}
+
+// ftpReader downloads a file once it is first read, so that
+// items waiting to be transferred don't hold a connection.
+type ftpReader struct {
+	ctx     context.Context
+	storage *FTPStorage
+	path    string
+	conn    *ftpConn
+	data    io.ReadCloser
+	err     error
+}
+
+func (r *ftpReader) Read(p []byte) (int, error) {
+	if r.data == nil && r.err == nil {
+		r.conn, r.err = r.storage.conn(r.ctx)
+		if r.err == nil {
+			r.data, r.err = r.conn.retrieve(r.path)
+			if r.err != nil {
+				r.conn.Close()
+				r.conn = nil
+			}
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.data.Read(p)
+}
+
+func (r *ftpReader) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	err := r.data.Close()
+	r.data = nil
+	if err != nil {
+		r.conn.Close()
+		return err
+	}
+	r.storage.release(r.conn)
+	return nil
+}
+
+// ftpConn is a control connection to an FTP server.
+type ftpConn struct {
+	net.Conn
+	text      *textproto.Conn
+	tlsConfig *tls.Config
+	// limiter, if set, limits the data connections.
+	limiter *RateLimiter
+	// aborted is set once a command has been aborted by abortOn,
+	// which leaves the connection unusable.
+	aborted int32
+}
+
+func dialFTP(ctx context.Context, addr string, tlsConfig *tls.Config, user, password string) (*ftpConn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &ftpConn{Conn: conn, text: textproto.NewConn(conn)}
+	err = c.login(tlsConfig, user, password)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// abortOn makes commands on the connection fail once ctx is
+// cancelled, until the returned function is called.
+func (c *ftpConn) abortOn(ctx context.Context) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt32(&c.aborted, 1)
+			c.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (c *ftpConn) login(tlsConfig *tls.Config, user, password string) error {
+	_, _, err := c.text.ReadResponse(2)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		_, _, err = c.cmd(2, "AUTH TLS")
+		if err != nil {
+			return err
+		}
+		c.Conn = tls.Client(c.Conn, tlsConfig)
+		c.text = textproto.NewConn(c.Conn)
+		c.tlsConfig = tlsConfig
+		_, _, err = c.cmd(2, "PBSZ 0")
+		if err != nil {
+			return err
+		}
+		_, _, err = c.cmd(2, "PROT P")
+		if err != nil {
+			return err
+		}
+	}
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	if code != 230 && code != 331 {
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+	if code == 331 {
+		_, _, err = c.cmd(2, "PASS %s", password)
+		if err != nil {
+			return err
+		}
+	}
+	_, _, err = c.cmd(2, "TYPE I")
+	return err
+}
+
+// cmd sends a command and reads the response, which must start with
+// expectCode (see textproto.Reader.ReadResponse).
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	err := c.text.PrintfLine(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	code, msg, err := c.text.ReadResponse(expectCode)
+	if logLevel >= LogDebug {
+		cmd := fmt.Sprintf(format, args...)
+		if strings.HasPrefix(cmd, "PASS ") {
+			cmd = "PASS ***"
+		}
+		debugf("%s: %d %s", cmd, code, msg)
+	}
+	return code, msg, err
+}
+
+// transfer opens a passive data connection and sends a command
+// that transfers data over it.
+func (c *ftpConn) transfer(format string, args ...interface{}) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	var port int
+	_, msg, err := c.cmd(2, "EPSV")
+	if err == nil {
+		// 229 Entering Extended Passive Mode (|||port|)
+		start := strings.Index(msg, "(|||")
+		end := strings.LastIndex(msg, "|)")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("Invalid EPSV response %q", msg)
+		}
+		port, err = strconv.Atoi(msg[start+4 : end])
+	} else {
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		_, msg, err = c.cmd(2, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		start := strings.Index(msg, "(")
+		end := strings.LastIndex(msg, ")")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("Invalid PASV response %q", msg)
+		}
+		fields := strings.Split(msg[start+1:end], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("Invalid PASV response %q", msg)
+		}
+		p1, err1 := strconv.Atoi(fields[4])
+		p2, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("Invalid PASV response %q", msg)
+		}
+		// The address in the response is ignored as it is often
+		// wrong for servers behind NAT.
+		port = p1<<8 | p2
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if c.limiter != nil {
+		data = c.limiter.Conn(data)
+	}
+	if c.tlsConfig != nil {
+		data = tls.Client(data, c.tlsConfig)
+	}
+	_, _, err = c.cmd(1, format, args...)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return data, nil
+}
+
+// ftpData is a data connection whose transfer is complete
+// once the server has confirmed it after closing.
+type ftpData struct {
+	net.Conn
+	control *ftpConn
+}
+
+func (d *ftpData) Close() error {
+	err := d.Conn.Close()
+	if err != nil {
+		return err
+	}
+	_, _, err = d.control.text.ReadResponse(2)
+	return err
+}
+
+func (c *ftpConn) retrieve(path string) (io.ReadCloser, error) {
+	data, err := c.transfer("RETR %s", path)
+	if err != nil {
+		return nil, err
+	}
+	return &ftpData{data, c}, nil
+}
+
+func (c *ftpConn) store(path string, r io.Reader) error {
+	data, err := c.transfer("STOR %s", path)
+	if err != nil {
+		return err
+	}
+	d := &ftpData{data, c}
+	_, err = io.Copy(d, r)
+	if err != nil {
+		d.Conn.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// ftpEntry is a file or directory in a directory listing.
+type ftpEntry struct {
+	Path    string
+	Type    string
+	Size    int64
+	ModTime time.Time
+}
+
+// list lists dir using MLSD, falling back to parsing the
+// Unix-style output of LIST for servers that don't support it.
+func (c *ftpConn) list(dir string) ([]ftpEntry, error) {
+	parse := parseMLSD
+	data, err := c.transfer("MLSD %s", dir)
+	if _, isProtocolError := err.(*textproto.Error); isProtocolError {
+		parse = parseLIST
+		data, err = c.transfer("LIST %s", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d := &ftpData{data, c}
+	var entries []ftpEntry
+	scanner := bufio.NewScanner(d)
+	for scanner.Scan() {
+		entry, ok := parse(strings.TrimRight(scanner.Text(), "\r"))
+		if !ok || entry.Path == "." || entry.Path == ".." {
+			continue
+		}
+		entry.Path = path.Join(dir, entry.Path)
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		d.Conn.Close()
+		return nil, err
+	}
+	return entries, d.Close()
+}
+
+// parseMLSD parses a line like
+// `type=file;size=1024;modify=20170102150405; name`.
+func parseMLSD(line string) (ftpEntry, bool) {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return ftpEntry{}, false
+	}
+	entry := ftpEntry{Path: parts[1]}
+	for _, fact := range strings.Split(parts[0], ";") {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch strings.ToLower(kv[0]) {
+		case "type":
+			entry.Type = strings.ToLower(kv[1])
+		case "size":
+			entry.Size, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "modify":
+			// Fractions of seconds are optional.
+			modify := strings.SplitN(kv[1], ".", 2)[0]
+			entry.ModTime, _ = time.Parse("20060102150405", modify)
+		}
+	}
+	return entry, true
+}
+
+// parseLIST parses a line like
+// `-rw-r--r--   1 user group   1024 Jan  2 15:04 name`.
+func parseLIST(line string) (ftpEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 9 {
+		return ftpEntry{}, false
+	}
+	entry := ftpEntry{}
+	switch line[0] {
+	case 'd':
+		entry.Type = "dir"
+	case '-':
+		entry.Type = "file"
+	default:
+		return ftpEntry{}, false
+	}
+	entry.Size, _ = strconv.ParseInt(fields[4], 10, 64)
+	date := strings.Join(fields[5:8], " ")
+	if t, err := time.Parse("Jan 2 2006", date); err == nil {
+		entry.ModTime = t
+	} else if t, err := time.Parse("Jan 2 15:04", date); err == nil {
+		// Dates without a year are within the last six months.
+		now := time.Now().UTC()
+		entry.ModTime = t.AddDate(now.Year(), 0, 0)
+		if entry.ModTime.After(now) {
+			entry.ModTime = entry.ModTime.AddDate(-1, 0, 0)
+		}
+	}
+	// The name is everything after the date, which may contain spaces.
+	rest := line
+	for i := 0; i < 8; i++ {
+		rest = strings.TrimLeft(rest, " ")
+		rest = rest[strings.Index(rest, " "):]
+	}
+	entry.Path = strings.TrimLeft(rest, " ")
+	return entry, true
+}
@@ -0,0 +1,434 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const gcsEndpoint = "https://storage.googleapis.com"
+
+// GCSStorage uses the JSON API of Google Cloud Storage, which
+// (unlike the S3-compatible XML API) authenticates with OAuth.
+type GCSStorage struct {
+	bucket string
+	prefix string
+	token  *GoogleToken
+	// Client sends the requests to the bucket.
+	Client *http.Client
+	// ACL is the predefined ACL applied to uploaded objects.
+	// If empty, the bucket's default object ACL is used.
+	ACL          string
+	CacheControl string
+	ContentType  string
+	Metadata     map[string]string
+}
+
+// GCS names of the canned ACLs.
+var gcsPredefinedACLs = map[string]string{
+	"private":                   "private",
+	"public-read":               "publicRead",
+	"public-read-write":         "publicReadWrite",
+	"authenticated-read":        "authenticatedRead",
+	"bucket-owner-read":         "bucketOwnerRead",
+	"bucket-owner-full-control": "bucketOwnerFullControl",
+}
+
+// NewGCSStorage creates a storage for a URL like `gs://bucket`.
+// credentials is the path of a service account key file or empty
+// to use the application default credentials.
+func NewGCSStorage(bucketUrl, credentials, prefix string) (*GCSStorage, error) {
+	u, err := url.Parse(bucketUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "gs" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid GCS URL %s", bucketUrl)
+	}
+	token, err := NewGoogleToken(credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &GCSStorage{
+		bucket: u.Host,
+		prefix: prefix,
+		token:  token,
+		Client: NewHTTPClient(),
+	}, nil
+}
+
+// gcsObject is the object resource of the JSON API.
+type gcsObject struct {
+	Name         string            `json:"name"`
+	Size         string            `json:"size,omitempty"`
+	Updated      string            `json:"updated,omitempty"`
+	MD5Hash      string            `json:"md5Hash,omitempty"`
+	CRC32C       string            `json:"crc32c,omitempty"`
+	ContentType  string            `json:"contentType,omitempty"`
+	CacheControl string            `json:"cacheControl,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// request sends an authenticated request to the JSON API. Responses
+// with a status other than 2xx are turned into an error.
+func (s *GCSStorage) request(ctx context.Context, method, u string, header http.Header, body io.Reader) (*http.Response, error) {
+	resp, err := s.rawRequest(ctx, method, u, header, body, -1)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, decodeGCSError(resp)
+	}
+	return resp, nil
+}
+
+// rawRequest is like request but leaves checking the status to the
+// caller. If length is not negative, it is sent as Content-Length.
+func (s *GCSStorage) rawRequest(ctx context.Context, method, u string, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	token, err := s.token.Get(s.Client)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if length >= 0 {
+		req.ContentLength = length
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.Client.Do(req)
+}
+
+// decodeGCSError turns an error response into a *gcsError.
+func decodeGCSError(resp *http.Response) error {
+	defer resp.Body.Close()
+	var result struct {
+		Error *gcsError `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	if result.Error == nil {
+		result.Error = &gcsError{Message: resp.Status}
+	}
+	result.Error.StatusCode = resp.StatusCode
+	return result.Error
+}
+
+// gcsError is an error reported by the JSON API.
+type gcsError struct {
+	StatusCode int
+	Message    string `json:"message"`
+}
+
+func (e *gcsError) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Message, e.StatusCode)
+}
+
+// GCS hashes objects with CRC32C (Castagnoli). Unlike MD5, the hash
+// is also available for composite objects.
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// encodeCRC32C formats sum the way the JSON API does: base64 of the
+// big-endian bytes.
+func encodeCRC32C(sum uint32) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, sum)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// verify compares the hashes GCS calculated for an upload with the
+// local ones. Like gsutil, an object that doesn't match is deleted.
+func (s *GCSStorage) verify(result *gcsObject, md5sum []byte, crc uint32) error {
+	var err error
+	if local := encodeCRC32C(crc); result.CRC32C != local {
+		err = fmt.Errorf("CRC32C mismatch for %s: local %s, remote %s", result.Name, local, result.CRC32C)
+	} else if local := base64.StdEncoding.EncodeToString(md5sum); result.MD5Hash != "" && result.MD5Hash != local {
+		err = fmt.Errorf("Checksum mismatch for %s: local %s, remote %s", result.Name, local, result.MD5Hash)
+	}
+	if err != nil {
+		resp, delErr := s.request(context.Background(), "DELETE", s.objectURL(result.Name), nil, nil)
+		if delErr != nil {
+			log.Printf("Could not delete corrupted object %s: %s", result.Name, delErr)
+		} else {
+			resp.Body.Close()
+		}
+	}
+	return err
+}
+
+func (s *GCSStorage) objectURL(name string) string {
+	return gcsEndpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o/" + url.PathEscape(name)
+}
+
+func (s *GCSStorage) item(obj gcsObject) *Item {
+	size, _ := strconv.ParseInt(obj.Size, 10, 64)
+	modTime, _ := time.Parse(time.RFC3339, obj.Updated)
+	item := &Item{
+		Prefix:   s.prefix,
+		Path:     obj.Name,
+		Size:     size,
+		ModTime:  modTime,
+		Metadata: obj.Metadata,
+	}
+	// Composite objects have no MD5 hash.
+	if sum, err := base64.StdEncoding.DecodeString(obj.MD5Hash); err == nil && len(sum) > 0 {
+		item.ETag = hex.EncodeToString(sum)
+	}
+	if mode, err := strconv.ParseUint(obj.Metadata["mode"], 8, 32); err == nil {
+		item.Mode = os.FileMode(mode).Perm()
+	}
+	return item
+}
+
+func (s *GCSStorage) ListFiles(ctx context.Context) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		params := url.Values{"prefix": {s.prefix}}
+		for {
+			u := gcsEndpoint + "/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + params.Encode()
+			resp, err := s.request(ctx, "GET", u, nil, nil)
+			if err != nil {
+				return fmt.Errorf("Could not list items in bucket %s: %s", s.bucket, err)
+			}
+			var result struct {
+				Items         []gcsObject `json:"items"`
+				NextPageToken string      `json:"nextPageToken"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+			if err != nil {
+				return fmt.Errorf("Could not list items in bucket %s: %s", s.bucket, err)
+			}
+			for _, obj := range result.Items {
+				obj := obj
+				item := s.item(obj)
+				item.Open = func(ctx context.Context, item *Item) error {
+					item.ReadCloser = &gcsReader{ctx: ctx, storage: s, name: obj.Name, crc32c: obj.CRC32C}
+					return nil
+				}
+				if !sendItem(ctx, c, item) {
+					return nil
+				}
+			}
+			if result.NextPageToken == "" {
+				return nil
+			}
+			params.Set("pageToken", result.NextPageToken)
+		}
+	})
+}
+
+// StatFiles is ListFiles, as its items are only opened when read.
+func (s *GCSStorage) StatFiles(ctx context.Context) <-chan *Item {
+	items, _ := s.ListFiles(ctx)
+	return items
+}
+
+func (s *GCSStorage) key(item *Item) string {
+	return filepath.ToSlash(filepath.Join(s.prefix, strings.TrimPrefix(item.Path, item.Prefix)))
+}
+
+// stat returns the metadata of the object item would be stored as
+// or nil if there is no such object.
+func (s *GCSStorage) stat(ctx context.Context, item *Item) (*Item, error) {
+	obj, err := s.lookup(ctx, s.key(item))
+	if obj == nil || err != nil {
+		return nil, err
+	}
+	return s.item(*obj), nil
+}
+
+// Stat looks up the object at path. The ETag is its MD5 hash.
+func (s *GCSStorage) Stat(ctx context.Context, path string) (*ItemInfo, error) {
+	obj, err := s.lookup(ctx, filepath.ToSlash(filepath.Join(s.prefix, path)))
+	if obj == nil || err != nil {
+		return nil, err
+	}
+	item := s.item(*obj)
+	return &ItemInfo{
+		Size:        item.Size,
+		ModTime:     item.ModTime,
+		ETag:        item.ETag,
+		ContentType: obj.ContentType,
+	}, nil
+}
+
+// lookup fetches the resource of the object called name
+// or returns nil if there is no such object.
+func (s *GCSStorage) lookup(ctx context.Context, name string) (*gcsObject, error) {
+	resp, err := s.request(ctx, "GET", s.objectURL(name), nil, nil)
+	if gcserr, ok := err.(*gcsError); ok && gcserr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var obj gcsObject
+	err = json.NewDecoder(resp.Body).Decode(&obj)
+	if err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+// object returns the object resource item is uploaded with.
+func (s *GCSStorage) object(item *Item) (gcsObject, error) {
+	obj := gcsObject{
+		Name:         s.key(item),
+		ContentType:  s.ContentType,
+		CacheControl: s.CacheControl,
+		Metadata:     map[string]string{},
+	}
+	if obj.ContentType == "" {
+		obj.ContentType = mime.TypeByExtension(filepath.Ext(item.Path))
+	}
+	if obj.ContentType == "" {
+		contType, err := sniffContentType(item)
+		if err != nil {
+			return obj, err
+		}
+		obj.ContentType = contType
+	}
+	for name, value := range item.Metadata {
+		obj.Metadata[name] = value
+	}
+	for name, value := range s.Metadata {
+		obj.Metadata[name] = value
+	}
+	if item.Mode != 0 {
+		obj.Metadata["mode"] = fmt.Sprintf("%#o", item.Mode.Perm())
+	}
+	return obj, nil
+}
+
+// PutFile uploads item with a multipart request carrying the object's
+// metadata and content or, for big files, with a resumable upload.
+// The hashes calculated by GCS are compared with the local ones.
+func (s *GCSStorage) PutFile(ctx context.Context, item *Item) error {
+	defer item.Close()
+	obj, err := s.object(item)
+	if err != nil {
+		return err
+	}
+	if r, ok := item.ReadCloser.(io.ReaderAt); ok && item.Size >= multipartThreshold {
+		return s.putResumable(ctx, obj, item, r)
+	}
+	meta, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+
+	h := md5.New()
+	crc := crc32.New(crc32cTable)
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+		if err == nil {
+			_, err = part.Write(meta)
+		}
+		if err == nil {
+			part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {obj.ContentType}})
+		}
+		if err == nil {
+			_, err = io.Copy(part, io.TeeReader(item, io.MultiWriter(h, crc)))
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	params := url.Values{"uploadType": {"multipart"}}
+	if s.ACL != "" {
+		params.Set("predefinedAcl", gcsPredefinedACLs[s.ACL])
+	}
+	u := gcsEndpoint + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + params.Encode()
+	header := http.Header{"Content-Type": {"multipart/related; boundary=" + mw.Boundary()}}
+	resp, err := s.request(ctx, "POST", u, header, pr)
+	if err != nil {
+		// Stop reading item before it is closed.
+		pr.CloseWithError(err)
+		<-done
+		return err
+	}
+	defer resp.Body.Close()
+	var result gcsObject
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	return s.verify(&result, h.Sum(nil), crc.Sum32())
+}
+
+// gcsReader downloads an object once it is first read, so that
+// items waiting to be transferred don't hold a connection.
+// The content is checked against crc32c, if given.
+type gcsReader struct {
+	ctx     context.Context
+	storage *GCSStorage
+	name    string
+	crc32c  string
+	hash    hash.Hash32
+	body    io.ReadCloser
+	err     error
+}
+
+func (r *gcsReader) Read(p []byte) (int, error) {
+	if r.body == nil && r.err == nil {
+		var resp *http.Response
+		resp, r.err = r.storage.request(r.ctx, "GET", r.storage.objectURL(r.name)+"?alt=media", nil, nil)
+		if r.err == nil {
+			r.body = resp.Body
+			r.hash = crc32.New(crc32cTable)
+			// Objects stored gzip-compressed are served decompressed,
+			// so their content doesn't match the stored hash.
+			if resp.Header.Get("X-Goog-Stored-Content-Encoding") == "gzip" {
+				r.crc32c = ""
+			}
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.body.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && r.crc32c != "" {
+		if local := encodeCRC32C(r.hash.Sum32()); local != r.crc32c {
+			r.err = fmt.Errorf("CRC32C mismatch for %s: local %s, remote %s", r.name, local, r.crc32c)
+			return n, r.err
+		}
+	}
+	return n, err
+}
+
+func (r *gcsReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// putResumable uploads item in chunks using a resumable upload session.
+// The session URI is stored in the user's cache directory, so that an
+// interrupted upload is continued by the next run instead of restarted.
+// The CRC32C hash is sent along with the metadata, so that GCS
+// rejects the upload if the content it received doesn't match.
+// When ctx is cancelled, the session is kept for the next run.
+func (s *GCSStorage) putResumable(ctx context.Context, obj gcsObject, item *Item, r io.ReaderAt) error {
+	h := md5.New()
+	crc := crc32.New(crc32cTable)
+	_, err := io.Copy(io.MultiWriter(h, crc), io.NewSectionReader(r, 0, item.Size))
+	if err != nil {
+		return err
+	}
+	obj.CRC32C = encodeCRC32C(crc.Sum32())
+
+	stateFile := s.sessionFile(obj.Name, item)
+	var session string
+	var offset int64
+	var result *gcsObject
+	if data, err := ioutil.ReadFile(stateFile); err == nil {
+		session = strings.TrimSpace(string(data))
+		offset, result, err = s.sessionStatus(ctx, session, item.Size)
+		if err != nil {
+			log.Printf("Could not resume upload of %s, restarting: %s", obj.Name, err)
+			session = ""
+		}
+	}
+	if session == "" {
+		session, err = s.startSession(ctx, obj, item.Size)
+		if err != nil {
+			return err
+		}
+		offset = 0
+		err = os.MkdirAll(filepath.Dir(stateFile), 0700)
+		if err == nil {
+			err = ioutil.WriteFile(stateFile, []byte(session), 0600)
+		}
+		if err != nil {
+			log.Printf("Could not save upload session of %s: %s", obj.Name, err)
+		}
+	}
+
+	for result == nil {
+		end := offset + multipartPartSize
+		if end > item.Size {
+			end = item.Size
+		}
+		header := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", offset, end-1, item.Size)}}
+		resp, err := s.rawRequest(ctx, "PUT", session, header, io.NewSectionReader(r, offset, end-offset), end-offset)
+		if err != nil {
+			return err
+		}
+		offset, result, err = uploadProgress(resp)
+		if err != nil {
+			return err
+		}
+	}
+	os.Remove(stateFile)
+	return s.verify(result, h.Sum(nil), crc.Sum32())
+}
+
+// sessionFile returns the path the upload session of item is stored at.
+// Sessions are only resumed for the same version of the file.
+func (s *GCSStorage) sessionFile(name string, item *Item) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	id := sha1.Sum([]byte(fmt.Sprintf("%s\n%s\n%d\n%d", s.bucket, name, item.Size, item.ModTime.UnixNano())))
+	return filepath.Join(dir, "s3put", "gcs-sessions", hex.EncodeToString(id[:]))
+}
+
+// startSession initiates a resumable upload and returns the session URI.
+func (s *GCSStorage) startSession(ctx context.Context, obj gcsObject, size int64) (string, error) {
+	meta, err := json.Marshal(obj)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{"uploadType": {"resumable"}}
+	if s.ACL != "" {
+		params.Set("predefinedAcl", gcsPredefinedACLs[s.ACL])
+	}
+	u := gcsEndpoint + "/upload/storage/v1/b/" + url.PathEscape(s.bucket) + "/o?" + params.Encode()
+	header := http.Header{
+		"Content-Type":            {"application/json; charset=UTF-8"},
+		"X-Upload-Content-Type":   {obj.ContentType},
+		"X-Upload-Content-Length": {strconv.FormatInt(size, 10)},
+	}
+	resp, err := s.request(ctx, "POST", u, header, strings.NewReader(string(meta)))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	session := resp.Header.Get("Location")
+	if session == "" {
+		return "", fmt.Errorf("No upload session returned for %s", obj.Name)
+	}
+	return session, nil
+}
+
+// sessionStatus asks how much of an upload session has been received.
+func (s *GCSStorage) sessionStatus(ctx context.Context, session string, size int64) (int64, *gcsObject, error) {
+	header := http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", size)}}
+	resp, err := s.rawRequest(ctx, "PUT", session, header, nil, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	return uploadProgress(resp)
+}
+
+// uploadProgress interprets the response to a chunk upload or status
+// query. Status 308 reports how many bytes have been received so far,
+// 200 and 201 that the upload is complete.
+func uploadProgress(resp *http.Response) (int64, *gcsObject, error) {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		defer resp.Body.Close()
+		var obj gcsObject
+		err := json.NewDecoder(resp.Body).Decode(&obj)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, &obj, nil
+	case http.StatusPermanentRedirect:
+		resp.Body.Close()
+		// Range: bytes=0-<last received byte>
+		received := resp.Header.Get("Range")
+		if received == "" {
+			return 0, nil, nil
+		}
+		last, err := strconv.ParseInt(received[strings.LastIndex(received, "-")+1:], 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Invalid range %q", received)
+		}
+		return last + 1, nil, nil
+	}
+	return 0, nil, decodeGCSError(resp)
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	googleTokenURL     = "https://oauth2.googleapis.com/token"
+	googleMetadataURL  = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	googleStorageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+)
+
+// GoogleToken provides OAuth access tokens for Google APIs and
+// refreshes them before they expire.
+type GoogleToken struct {
+	// fetch requests a new access token with client.
+	fetch func(client *http.Client) (*googleTokenResponse, error)
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+type googleTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Get returns a valid access token. New tokens are requested with
+// client, so that they take the same route as the storage requests.
+func (t *GoogleToken) Get(client *http.Client) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+	resp, err := t.fetch(client)
+	if err != nil {
+		return "", fmt.Errorf("Could not get access token: %s", err)
+	}
+	t.token = resp.AccessToken
+	t.expiry = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return t.token, nil
+}
+
+// googleCredentials is the content of a service account key file
+// or of the application default credentials created by
+// `gcloud auth application-default login`.
+type googleCredentials struct {
+	Type string `json:"type"`
+	// Service accounts
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	// Users
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// NewGoogleToken loads the credentials from the JSON file at path.
+// If path is empty, the application default credentials are used:
+// The file in $GOOGLE_APPLICATION_CREDENTIALS, the one written by
+// gcloud or, on Google Compute Engine, the instance's service account.
+func NewGoogleToken(path string) (*GoogleToken, error) {
+	if path == "" {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path == "" {
+		path = gcloudCredentialsPath()
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// The metadata server is reached directly.
+			return &GoogleToken{fetch: func(*http.Client) (*googleTokenResponse, error) {
+				return fetchMetadataToken()
+			}}, nil
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds googleCredentials
+	err = json.Unmarshal(data, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid credentials file %s: %s", path, err)
+	}
+	switch creds.Type {
+	case "service_account":
+		block, _ := pem.Decode([]byte(creds.PrivateKey))
+		if block == nil {
+			return nil, errors.New("Invalid private key in credentials file")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("Private key in credentials file is not an RSA key")
+		}
+		if creds.TokenURI == "" {
+			creds.TokenURI = googleTokenURL
+		}
+		return &GoogleToken{fetch: func(client *http.Client) (*googleTokenResponse, error) {
+			return fetchServiceAccountToken(client, creds, rsaKey)
+		}}, nil
+	case "authorized_user":
+		return &GoogleToken{fetch: func(client *http.Client) (*googleTokenResponse, error) {
+			return postTokenRequest(client, googleTokenURL, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		}}, nil
+	}
+	return nil, fmt.Errorf("Unsupported credentials type %q in %s", creds.Type, path)
+}
+
+func gcloudCredentialsPath() string {
+	if dir := os.Getenv("APPDATA"); dir != "" {
+		return filepath.Join(dir, "gcloud", "application_default_credentials.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".config", "gcloud", "application_default_credentials.json")
+}
+
+// fetchServiceAccountToken exchanges a JWT signed with the service
+// account's key for an access token.
+func fetchServiceAccountToken(client *http.Client, creds googleCredentials, key *rsa.PrivateKey) (*googleTokenResponse, error) {
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": googleStorageScope,
+		"aud":   creds.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return postTokenRequest(client, creds.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(signature)},
+	})
+}
+
+func postTokenRequest(client *http.Client, tokenURL string, form url.Values) (*googleTokenResponse, error) {
+	resp, err := client.Post(tokenURL, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	return decodeTokenResponse(resp)
+}
+
+// fetchMetadataToken gets a token for the service account of the
+// Google Compute Engine instance s3put runs on.
+func fetchMetadataToken() (*googleTokenResponse, error) {
+	req, err := http.NewRequest("GET", googleMetadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("No credentials found (%s)", err)
+	}
+	return decodeTokenResponse(resp)
+}
+
+func decodeTokenResponse(resp *http.Response) (*googleTokenResponse, error) {
+	defer resp.Body.Close()
+	var token googleTokenResponse
+	err := json.NewDecoder(resp.Body).Decode(&token)
+	if resp.StatusCode != http.StatusOK {
+		if err == nil && token.Error != "" {
+			return nil, fmt.Errorf("%s: %s", token.Error, token.ErrorDescription)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
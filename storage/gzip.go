@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// shouldGzip reports whether item is to be uploaded compressed.
+func (s *S3Storage) shouldGzip(item *Item) bool {
+	if !s.Gzip {
+		return false
+	}
+	if len(s.GzipPatterns) == 0 {
+		return true
+	}
+	relpath := filepath.ToSlash(relativePath(item.Path, item.Prefix))
+	for _, pattern := range s.GzipPatterns {
+		if (FilterRule{Pattern: pattern}).matches(relpath, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compressed objects record the size and MD5 sum of their content
+// before compression in these metadata entries, so that they can be
+// compared with local files.
+const (
+	metaUncompressedSize = "s3put-size"
+	metaUncompressedMD5  = "s3put-md5"
+)
+
+// gzipItem compresses the content of item into a temporary file.
+// The returned item reads from that file, which is removed when the
+// item is closed. Compressing upfront is necessary as uploads
+// need to know their size in advance. sum is the MD5 sum of the
+// content before compression.
+func gzipItem(item *Item) (gzitem *Item, sum string, err error) {
+	f, err := ioutil.TempFile("", "s3put")
+	if err != nil {
+		return nil, "", err
+	}
+	tf := &tempFile{f}
+	h := md5.New()
+	gz := gzip.NewWriter(f)
+	_, err = io.Copy(gz, io.TeeReader(item, h))
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		tf.Close()
+		return nil, "", err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tf.Close()
+		return nil, "", err
+	}
+	compressed := *item
+	compressed.Size = size
+	compressed.ReadCloser = tf
+	return &compressed, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// uncompressedItem returns existing, the compressed object stored at
+// key, with the size and MD5 sum of its content before compression.
+// Objects without them are returned as they are.
+func (s *S3Storage) uncompressedItem(ctx context.Context, key string, existing *Item) (*Item, error) {
+	resp, err := s.request(ctx, "HEAD", key, nil, s.sseCustomerHeader(), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	size, err := strconv.ParseInt(resp.Header.Get("X-Amz-Meta-"+metaUncompressedSize), 10, 64)
+	sum := resp.Header.Get("X-Amz-Meta-" + metaUncompressedMD5)
+	if err != nil || sum == "" {
+		return existing, nil
+	}
+	uncompressed := *existing
+	uncompressed.Size = size
+	uncompressed.ETag = sum
+	return &uncompressed, nil
+}
+
+// gunzip returns a reader of the decompressed content of rc. Closing
+// it also closes rc.
+func gunzip(rc io.ReadCloser) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	return &gunzipReader{gz, rc}, nil
+}
+
+type gunzipReader struct {
+	*gzip.Reader
+	rc io.ReadCloser
+}
+
+func (g *gunzipReader) Close() error {
+	g.Reader.Close()
+	return g.rc.Close()
+}
+
+type tempFile struct {
+	*os.File
+}
+
+func (t *tempFile) Close() error {
+	t.File.Close()
+	return os.Remove(t.Name())
+}
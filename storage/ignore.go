@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// IgnoreFileName is the name of the file in the root of a local
+// tree that lists gitignore-style patterns of files not to upload.
+const IgnoreFileName = ".s3ignore"
+
+// ReadIgnoreFile reads a gitignore-style file into a Filter. A missing
+// file yields an empty Filter.
+func ReadIgnoreFile(path string) (Filter, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules Filter
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := FilterRule{Include: false, Pattern: line}
+		if strings.HasPrefix(line, "!") {
+			rule = FilterRule{Include: true, Pattern: line[1:]}
+		}
+		rule.Pattern = strings.TrimPrefix(rule.Pattern, "\\")
+		// In gitignore files, a slash anywhere but at the
+		// end anchors the pattern.
+		if strings.Contains(strings.TrimSuffix(rule.Pattern, "/"), "/") && !strings.HasPrefix(rule.Pattern, "/") {
+			rule.Pattern = "/" + rule.Pattern
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// In gitignore files, the last matching pattern wins.
+	for i, j := 0, len(rules)-1; i < j; i, j = i+1, j-1 {
+		rules[i], rules[j] = rules[j], rules[i]
+	}
+	return append(rules, FilterRule{Include: false, Pattern: "/" + IgnoreFileName}), nil
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "s3put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, IgnoreFileName)
+	content := "*.log\n!keep.log\nbuild/out/\n\\#hash\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ReadIgnoreFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"debug.log", false},
+		{"keep.log", true},
+		{"build/out/app.js", false},
+		{"src/build/out/app.js", true},
+		{"#hash", false},
+		{IgnoreFileName, false},
+		{"sub/" + IgnoreFileName, true},
+		{"index.html", true},
+	}
+	for _, test := range tests {
+		if got := f.Match(test.path); got != test.want {
+			t.Errorf("Match(%q) = %v, want %v", test.path, got, test.want)
+		}
+	}
+
+	f, err = ReadIgnoreFile(filepath.Join(dir, "missing"))
+	if err != nil || f != nil {
+		t.Errorf("Missing file: got %v, %v, want no rules", f, err)
+	}
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	imdsEndpoint = "http://169.254.169.254/latest"
+	ecsEndpoint  = "http://169.254.170.2"
+)
+
+// imdsClient gives up quickly, as the metadata service doesn't exist
+// outside of EC2 and ECS. Like the AWS SDKs, it only waits 200ms for
+// the connection, so that runs without keys don't hang on laptops.
+// The service is link-local and never reached through a proxy.
+var imdsClient = &http.Client{
+	Timeout: 2 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 200 * time.Millisecond}).DialContext,
+	},
+}
+
+// instanceCredentials returns the credentials of the role of the EC2
+// instance s3put runs on or nil if it doesn't run on EC2 or the
+// instance has no role.
+func instanceCredentials() *AWSCredentials {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil
+	}
+	c := &AWSCredentials{fetch: fetchInstanceKeys}
+	if _, err := c.Get(); err != nil {
+		return nil
+	}
+	return c
+}
+
+// fetchInstanceKeys gets the role's temporary keys from the instance
+// metadata service, using a session token (IMDSv2).
+func fetchInstanceKeys() (AWSKeys, time.Time, error) {
+	req, err := http.NewRequest("PUT", imdsEndpoint+"/api/token", nil)
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	token, err := imdsRequest(req)
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequest("GET", imdsEndpoint+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		return imdsRequest(req)
+	}
+	roles, err := get("/meta-data/iam/security-credentials/")
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(roles, "\n", 2)[0])
+	if role == "" {
+		return AWSKeys{}, time.Time{}, errors.New("Instance has no role")
+	}
+	data, err := get("/meta-data/iam/security-credentials/" + role)
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+	return decodeTemporaryKeys([]byte(data))
+}
+
+// containerCredentials returns the credentials of the task role of the
+// ECS task s3put runs in. ECS passes the path they are served at in
+// $AWS_CONTAINER_CREDENTIALS_RELATIVE_URI.
+func containerCredentials(relativeURI string) *AWSCredentials {
+	return &AWSCredentials{fetch: func() (AWSKeys, time.Time, error) {
+		req, err := http.NewRequest("GET", ecsEndpoint+relativeURI, nil)
+		if err != nil {
+			return AWSKeys{}, time.Time{}, err
+		}
+		data, err := imdsRequest(req)
+		if err != nil {
+			return AWSKeys{}, time.Time{}, err
+		}
+		return decodeTemporaryKeys([]byte(data))
+	}}
+}
+
+func imdsRequest(req *http.Request) (string, error) {
+	resp, err := imdsClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	return string(data), err
+}
+
+// decodeTemporaryKeys parses temporary keys in the format of the
+// EC2 and ECS metadata services.
+func decodeTemporaryKeys(data []byte) (AWSKeys, time.Time, error) {
+	var result struct {
+		Code            string
+		Message         string
+		AccessKeyId     string
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	err := json.Unmarshal(data, &result)
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+	if result.Code != "" && result.Code != "Success" {
+		return AWSKeys{}, time.Time{}, fmt.Errorf("%s: %s", result.Code, result.Message)
+	}
+	return AWSKeys{
+		AccessKey:    result.AccessKeyId,
+		SecretKey:    result.SecretAccessKey,
+		SessionToken: result.Token,
+	}, result.Expiration, nil
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// The keyring of the operating system is accessed through keyringGet
+// and keyringSet, which are implemented per platform. Secrets are
+// identified by a service and an account name.
+const keyringService = "s3put"
+
+// errKeyringNotFound is returned by keyringGet if there is no secret
+// or no keyring to look it up in.
+var errKeyringNotFound = errors.New("Not found in keyring")
+
+// keyringKeys is how keys are stored in the keyring.
+type keyringKeys struct {
+	AccessKeyId     string
+	SecretAccessKey string
+}
+
+// SaveKeyringKeys stores keys for profile in the keyring.
+func SaveKeyringKeys(profile string, keys AWSKeys) error {
+	data, err := json.Marshal(keyringKeys{
+		AccessKeyId:     keys.AccessKey,
+		SecretAccessKey: keys.SecretKey,
+	})
+	if err != nil {
+		return err
+	}
+	return keyringSet(keyringService, profile, string(data))
+}
+
+// keyringCredentials returns the keys stored for profile in the
+// keyring or nil if there are none.
+func keyringCredentials(profile string) (*AWSCredentials, error) {
+	secret, err := keyringGet(keyringService, profile)
+	if err == errKeyringNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys keyringKeys
+	err = json.Unmarshal([]byte(secret), &keys)
+	if err != nil {
+		return nil, errors.New("Invalid keys in keyring")
+	}
+	return StaticAWSCredentials(AWSKeys{
+		AccessKey: keys.AccessKeyId,
+		SecretKey: keys.SecretAccessKey,
+	}), nil
+}
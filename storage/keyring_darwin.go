@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// On macOS, the login keychain is accessed with `security`.
+
+func keyringGet(service, account string) (string, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		// Exit status 44 means the item doesn't exist.
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 44 {
+			return "", errKeyringNotFound
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", errKeyringNotFound
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func keyringSet(service, account, secret string) error {
+	if strings.ContainsAny(service+account, "\r\n") {
+		return errors.New("Keychain service and account must not contain line breaks")
+	}
+	// The command is passed on stdin so the secret doesn't show up in
+	// the process list, hex-encoded to avoid having to quote it.
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -X %s\n",
+		securityQuote(service), securityQuote(account), hex.EncodeToString([]byte(secret))))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil && stderr.Len() > 0 {
+		err = errors.New(strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// securityQuote quotes s as a single argument of a command
+// read by `security -i`.
+func securityQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
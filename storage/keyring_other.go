@@ -0,0 +1,36 @@
+//go:build !darwin && !windows
+// +build !darwin,!windows
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// On other systems, the Secret Service (GNOME Keyring, KWallet) is
+// accessed with `secret-tool` from libsecret.
+
+func keyringGet(service, account string) (string, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	if err != nil {
+		// secret-tool doesn't distinguish missing secrets from
+		// other errors, like the Secret Service not running.
+		return "", errKeyringNotFound
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func keyringSet(service, account, secret string) error {
+	cmd := exec.Command("secret-tool", "store", "--label="+service+" "+account, "service", service, "account", account)
+	cmd.Stdin = strings.NewReader(secret)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil && stderr.Len() > 0 {
+		return errors.New(strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
@@ -0,0 +1,57 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel is how much is logged. Errors are always logged
+// with the standard logger.
+type LogLevel int
+
+const (
+	// LogQuiet only logs errors.
+	LogQuiet LogLevel = iota
+	// LogInfo logs every transfer.
+	LogInfo
+	// LogVerbose adds details like the parts of multipart uploads.
+	LogVerbose
+	// LogDebug adds every request.
+	LogDebug
+)
+
+var (
+	logLevel  = LogQuiet
+	logOutput func(level LogLevel, msg string)
+)
+
+// SetLogger makes the package log messages up to level by passing
+// them to output, or to the standard logger if output is nil. By
+// default, only errors are logged.
+func SetLogger(level LogLevel, output func(level LogLevel, msg string)) {
+	logLevel, logOutput = level, output
+}
+
+func infof(format string, args ...interface{}) {
+	logf(LogInfo, format, args...)
+}
+
+func verbosef(format string, args ...interface{}) {
+	logf(LogVerbose, format, args...)
+}
+
+func debugf(format string, args ...interface{}) {
+	logf(LogDebug, format, args...)
+}
+
+func logf(level LogLevel, format string, args ...interface{}) {
+	if logLevel < level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if logOutput == nil {
+		log.Print(msg)
+		return
+	}
+	logOutput(level, msg)
+}
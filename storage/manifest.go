@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/amz.v1/s3"
+)
+
+// Manifest records every object a run transferred with its size, the
+// MD5 of its content and the time the transfer finished, as an
+// auditable record of what has been moved. Files ending in `.json`
+// get a JSON array, all others CSV.
+type Manifest struct {
+	mu      sync.Mutex
+	f       *os.File
+	csv     *csv.Writer
+	entries int
+}
+
+// ManifestEntry is an object recorded in the manifest.
+type ManifestEntry struct {
+	Key  string    `json:"key"`
+	Size int64     `json:"size"`
+	MD5  string    `json:"md5"`
+	Time time.Time `json:"time"`
+}
+
+func CreateManifest(path string) (*Manifest, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{f: f}
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		_, err = f.WriteString("[")
+	} else {
+		m.csv = csv.NewWriter(f)
+		err = m.csv.Write([]string{"key", "size", "md5", "time"})
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Add records a transferred object.
+func (m *Manifest) Add(e ManifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries++
+	if m.csv != nil {
+		// Flush every line, so that the manifest is complete
+		// up to here if s3put dies.
+		err := m.csv.Write([]string{e.Key, strconv.FormatInt(e.Size, 10), e.MD5, e.Time.Format(time.RFC3339)})
+		if err != nil {
+			return err
+		}
+		m.csv.Flush()
+		return m.csv.Error()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	sep := ",\n  "
+	if m.entries == 1 {
+		sep = "\n  "
+	}
+	_, err = m.f.WriteString(sep + string(data))
+	return err
+}
+
+// Close finishes the manifest.
+func (m *Manifest) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var err error
+	if m.csv == nil {
+		end := "\n]\n"
+		if m.entries == 0 {
+			end = "]\n"
+		}
+		_, err = m.f.WriteString(end)
+	}
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// checksumItem makes item calculate the MD5 of its content
+// while it is transferred.
+func checksumItem(item *Item) *checksumReader {
+	cr := &checksumReader{h: md5.New(), size: item.Size}
+	item.wrap(func(item *Item) {
+		cr.ra, _ = item.ReadCloser.(s3.ReaderAtSeeker)
+	})
+	hookReads(item, readHooks{read: cr.read, close: cr.close})
+	return cr
+}
+
+// checksumReader hashes the content while it is read. Rewinding starts
+// over, e.g. after the content type has been sniffed. Multipart uploads
+// read the parts out of order, in that case the sum is calculated from
+// the file when it is closed.
+type checksumReader struct {
+	mu   sync.Mutex
+	ra   s3.ReaderAtSeeker
+	h    hash.Hash
+	n    int64
+	size int64
+	// unordered is set when the content
+	// hasn't been read from start to end.
+	unordered bool
+	closed    bool
+	sum       string
+}
+
+func (r *checksumReader) read(b []byte, off int64, ordered bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ordered && off == 0 {
+		r.h.Reset()
+		r.n = 0
+		r.unordered = false
+	}
+	if !ordered || off != r.n {
+		r.unordered = true
+		return
+	}
+	r.h.Write(b)
+	r.n += int64(len(b))
+}
+
+func (r *checksumReader) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	switch {
+	case !r.unordered && r.n == r.size:
+		r.sum = hex.EncodeToString(r.h.Sum(nil))
+	case r.ra != nil:
+		h := md5.New()
+		if _, err := io.Copy(h, io.NewSectionReader(r.ra, 0, r.size)); err == nil {
+			r.sum = hex.EncodeToString(h.Sum(nil))
+		}
+	}
+}
+
+// Sum returns the MD5 of the content once the item has been
+// closed. It is empty if the content hasn't been read completely.
+func (r *checksumReader) Sum() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sum
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStorage keeps files in memory, e.g. to try out a transfer
+// without touching a bucket or disk. Paths use forward slashes and
+// the zero value is an empty storage ready to use.
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	data     []byte
+	modTime  time.Time
+	mode     os.FileMode
+	metadata map[string]string
+	etag     string
+}
+
+// Put stores data at p as if it had been uploaded at modTime.
+func (s *MemoryStorage) Put(p string, data []byte, modTime time.Time) {
+	s.put(p, memoryFile{data: data, modTime: modTime})
+}
+
+// Get returns the content of the file at p.
+func (s *MemoryStorage) Get(p string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[memoryPath(p)]
+	return f.data, ok
+}
+
+// Paths returns the paths of all files in lexical order.
+func (s *MemoryStorage) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paths := make([]string, 0, len(s.files))
+	for p := range s.files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func (s *MemoryStorage) put(p string, f memoryFile) {
+	sum := md5.Sum(f.data)
+	f.etag = hex.EncodeToString(sum[:])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.files == nil {
+		s.files = map[string]memoryFile{}
+	}
+	s.files[memoryPath(p)] = f
+}
+
+// memoryPath is the path files at p are stored under,
+// which is the same as the key of items transferred there.
+func memoryPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// item returns an item for the file at p. s.mu must be held.
+func (s *MemoryStorage) item(p string, withContent bool) *Item {
+	f := s.files[p]
+	item := &Item{
+		Path:     p,
+		Size:     int64(len(f.data)),
+		ModTime:  f.modTime,
+		Mode:     f.mode,
+		ETag:     f.etag,
+		Metadata: f.metadata,
+	}
+	if withContent {
+		item.ReadCloser = memoryReader{bytes.NewReader(f.data)}
+	}
+	return item
+}
+
+// list sends the items for paths that exist to c and returns
+// the number of paths that don't.
+func (s *MemoryStorage) list(ctx context.Context, c chan<- *Item, paths []string, withContent bool) (missing int, ok bool) {
+	s.mu.Lock()
+	var items []*Item
+	for _, p := range paths {
+		if _, exists := s.files[p]; !exists {
+			log.Printf("Could not find %s", p)
+			missing++
+			continue
+		}
+		items = append(items, s.item(p, withContent))
+	}
+	s.mu.Unlock()
+	for _, item := range items {
+		if !sendItem(ctx, c, item) {
+			return missing, false
+		}
+	}
+	return missing, true
+}
+
+func (s *MemoryStorage) ListFiles(ctx context.Context) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		s.list(ctx, c, s.Paths(), true)
+		return nil
+	})
+}
+
+// StatFiles is ListFiles without the content of the files.
+func (s *MemoryStorage) StatFiles(ctx context.Context) <-chan *Item {
+	c := make(chan *Item)
+	go func() {
+		defer close(c)
+		s.list(ctx, c, s.Paths(), false)
+	}()
+	return c
+}
+
+// ListPaths is like ListFiles but only lists the files at paths.
+func (s *MemoryStorage) ListPaths(ctx context.Context, paths []string) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		var cleaned []string
+		for _, p := range paths {
+			cleaned = append(cleaned, memoryPath(p))
+		}
+		missing, ok := s.list(ctx, c, cleaned, true)
+		if !ok {
+			return nil
+		}
+		return skippedFiles(missing)
+	})
+}
+
+func (s *MemoryStorage) PutFile(ctx context.Context, item *Item) error {
+	defer item.Close()
+	data, err := ioutil.ReadAll(contextReader{ctx, item})
+	if err != nil {
+		return err
+	}
+	if item.Size >= 0 && int64(len(data)) != item.Size {
+		return fmt.Errorf("Expected %d bytes of %s, got %d", item.Size, item, len(data))
+	}
+	metadata := map[string]string{}
+	for name, value := range item.Metadata {
+		metadata[name] = value
+	}
+	s.put(item.Key(), memoryFile{
+		data:     data,
+		modTime:  item.ModTime,
+		mode:     item.Mode,
+		metadata: metadata,
+	})
+	return nil
+}
+
+// stat returns the metadata of the file item would be stored as
+// or nil if there is no such file.
+func (s *MemoryStorage) stat(ctx context.Context, item *Item) (*Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.files[item.Key()]; !ok {
+		return nil, nil
+	}
+	return s.item(item.Key(), false), nil
+}
+
+// Stat looks up the file at p. The ETag is the MD5 hash of its
+// content and the content type is guessed from the extension.
+func (s *MemoryStorage) Stat(ctx context.Context, p string) (*ItemInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[memoryPath(p)]
+	if !ok {
+		return nil, nil
+	}
+	return &ItemInfo{
+		Size:        int64(len(f.data)),
+		ModTime:     f.modTime,
+		ETag:        f.etag,
+		ContentType: mime.TypeByExtension(path.Ext(p)),
+	}, nil
+}
+
+// memoryReader keeps the random access methods of bytes.Reader,
+// so that the content can be uploaded in parts.
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Types missing from the system's or Go's builtin tables.
+var extraMimeTypes = map[string]string{
+	".mjs":         "text/javascript",
+	".wasm":        "application/wasm",
+	".webmanifest": "application/manifest+json",
+}
+
+func init() {
+	for ext, typ := range extraMimeTypes {
+		if mime.TypeByExtension(ext) == "" {
+			mime.AddExtensionType(ext, typ)
+		}
+	}
+}
+
+// LoadMimeMap registers the extension to type mappings in the file at
+// path. Each line contains an extension and a type, e.g.
+// `.wasm application/wasm`. Empty lines and lines starting with `#`
+// are ignored.
+func LoadMimeMap(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("Invalid line %q, must be `extension type`", line)
+		}
+		ext := fields[0]
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		err := mime.AddExtensionType(ext, fields[1])
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// sniffContentType guesses the type of item from its first 512 bytes
+// and rewinds it. Items that can't be rewound are not sniffed.
+func sniffContentType(item *Item) (string, error) {
+	rs, ok := item.ReadCloser.(io.ReadSeeker)
+	if !ok {
+		return "", nil
+	}
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(rs, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"os"
+)
+
+// OverwritePolicy decides what happens to items that
+// already exist in the destination storage.
+type OverwritePolicy int
+
+const (
+	// Always transfer the item.
+	OverwriteAlways OverwritePolicy = iota
+	// Never transfer an item if it already exists.
+	OverwriteNever
+	// Only transfer an item if it differs from the existing one.
+	OverwriteChanged
+	// Only transfer an item if it is newer than the existing one.
+	OverwriteOlder
+	// Only transfer an item if its size differs from the existing one.
+	OverwriteChangedSize
+)
+
+// stater is implemented by storages that can look up the
+// metadata of the item stored under the same path as a given item.
+type stater interface {
+	stat(ctx context.Context, item *Item) (*Item, error)
+}
+
+func shouldSkip(ctx context.Context, dst Storage, item *Item, policy OverwritePolicy) (bool, error) {
+	st, ok := dst.(stater)
+	if policy == OverwriteAlways || !ok {
+		return false, nil
+	}
+	existing, err := st.stat(ctx, item)
+	if err != nil || existing == nil {
+		return false, err
+	}
+	switch policy {
+	case OverwriteNever:
+		return true, nil
+	case OverwriteChanged:
+		if _, ok := dst.(*LocalStorage); ok && item.ETag == "" {
+			return sameFileContent(item, existing.Path)
+		}
+		return sameContent(item, existing)
+	case OverwriteOlder:
+		return !item.ModTime.After(existing.ModTime), nil
+	case OverwriteChangedSize:
+		return item.Size == existing.Size, nil
+	}
+	return false, nil
+}
+
+// sameContent compares item and existing by size and, using whichever
+// of the two has an ETag, by checksum.
+func sameContent(item, existing *Item) (bool, error) {
+	if item.Size != existing.Size {
+		return false, nil
+	}
+	switch {
+	case existing.ETag != "":
+		return matchesETag(item, existing.ETag)
+	case item.ETag != "":
+		return fileMatchesETag(existing.Path, existing.Size, item.ETag)
+	}
+	return false, nil
+}
+
+// sameFileContent compares item with the local file at path by
+// checksum. It is used when neither of them has an ETag, e.g. when
+// copying between local directories.
+func sameFileContent(item *Item, path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || fi.Size() != item.Size {
+		return false, err
+	}
+	etag, err := localETag(&Item{Size: fi.Size(), ReadCloser: f}, "")
+	if err != nil {
+		return false, err
+	}
+	return matchesETag(item, etag)
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// pipeItem streams the content of item through command, e.g. to encrypt
+// it before it is uploaded. Like with gzipItem, the output is stored
+// in a temporary file, as uploads need to know their size in advance.
+// item is closed in any case.
+func pipeItem(item *Item, command string) (*Item, error) {
+	defer item.Close()
+	f, err := ioutil.TempFile("", "s3put")
+	if err != nil {
+		return nil, err
+	}
+	tf := &tempFile{f}
+	cmd := ShellCommand(command)
+	cmd.Stdin = item
+	cmd.Stdout = f
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		tf.Close()
+		return nil, fmt.Errorf("%s failed: %s", command, err)
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tf.Close()
+		return nil, err
+	}
+	piped := *item
+	piped.Size = size
+	piped.ETag = ""
+	piped.ReadCloser = tf
+	return &piped, nil
+}
+
+// unpipeItem makes the content of item stream through command, e.g.
+// to decrypt it while it is downloaded. Like pipeItem, it closes item
+// if it fails.
+func unpipeItem(item *Item, command string) (*Item, error) {
+	cmd := ShellCommand(command)
+	cmd.Stdin = item.ReadCloser
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		item.Close()
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		item.Close()
+		return nil, fmt.Errorf("%s failed: %s", command, err)
+	}
+	unpiped := *item
+	unpiped.ReadCloser = &commandReader{out, cmd, command, item.ReadCloser, false}
+	return &unpiped, nil
+}
+
+// commandReader reads the output of cmd. Failures of the command
+// are reported at the end of its output.
+type commandReader struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	command string
+	in      io.Closer
+	waited  bool
+}
+
+func (r *commandReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF && !r.waited {
+		r.waited = true
+		if werr := r.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("%s failed: %s", r.command, werr)
+		}
+	}
+	return n, err
+}
+
+func (r *commandReader) Close() error {
+	// Closing the input and output makes the
+	// command end if it hasn't yet.
+	r.in.Close()
+	err := r.ReadCloser.Close()
+	if !r.waited {
+		r.waited = true
+		r.cmd.Wait()
+	}
+	return err
+}
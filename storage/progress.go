@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Progress tracks the transfers of CopyItems, so that their
+// state can be reported while they are running.
+type Progress struct {
+	// The progress of running transfers of files of at least
+	// LargeFileSize bytes is logged regularly. 0 disables it.
+	LargeFileSize int64
+
+	start time.Time
+
+	mu      sync.Mutex
+	stats   TransferStats
+	done    int64 // bytes of finished transfers
+	workers []workerProgress
+	// Bytes of all finished items, including skipped and failed ones.
+	processed int64
+	// The files to transfer, as far as they have been counted.
+	totalFiles, totalBytes int64
+	counting, counted      bool
+	failures               []Failure
+	// Bytes and time of the last report, to calculate
+	// the current throughput.
+	lastBytes int64
+	lastTime  time.Time
+	// resumed is closed when paused transfers are resumed.
+	// It is nil while they are running.
+	resumed chan struct{}
+}
+
+type workerProgress struct {
+	item    *Item
+	started time.Time
+	read    int64
+	// Bytes read and time of the last log message about the
+	// item, to calculate the current throughput.
+	lastRead int64
+	lastTime time.Time
+}
+
+func NewProgress(workers int) *Progress {
+	now := time.Now()
+	return &Progress{
+		start:    now,
+		workers:  make([]workerProgress, workers),
+		lastTime: now,
+	}
+}
+
+// begin records that worker starts transferring item and makes
+// reads from the item count towards the transferred bytes.
+func (p *Progress) begin(worker int, item *Item) {
+	p.mu.Lock()
+	now := time.Now()
+	p.workers[worker] = workerProgress{item: item, started: now, lastTime: now}
+	p.mu.Unlock()
+	hookReads(item, readHooks{
+		read: func(b []byte, off int64, ordered bool) {
+			p.add(worker, len(b))
+		},
+	})
+}
+
+// end records the outcome of worker's transfer.
+func (p *Progress) end(worker int, skipped bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	item := p.workers[worker].item
+	size := item.Size
+	if size < 0 {
+		size = 0
+	}
+	switch {
+	case err != nil:
+		p.stats.Failed++
+		p.failures = append(p.failures, Failure{Key: item.Key(), Error: err.Error()})
+	case skipped:
+		p.stats.Skipped++
+	default:
+		p.stats.Transferred++
+		p.done += size
+	}
+	p.processed += size
+	p.workers[worker] = workerProgress{}
+}
+
+// cancel records that an item was not transferred due to an interrupt.
+func (p *Progress) cancel() {
+	p.mu.Lock()
+	p.stats.Cancelled++
+	p.mu.Unlock()
+}
+
+func (p *Progress) add(worker int, n int) {
+	p.mu.Lock()
+	p.workers[worker].read += int64(n)
+	p.mu.Unlock()
+}
+
+// Count counts items, which should be the items to transfer without
+// content, to know how much there is to transfer in total.
+func (p *Progress) Count(items <-chan *Item) {
+	p.mu.Lock()
+	p.counting = true
+	p.mu.Unlock()
+	for item := range items {
+		item.Close()
+		p.mu.Lock()
+		p.totalFiles++
+		p.totalBytes += item.Size
+		p.mu.Unlock()
+	}
+	p.mu.Lock()
+	p.counted = true
+	p.mu.Unlock()
+}
+
+// logLargeFiles logs the progress of running transfers of large files
+// every interval until done is closed, so that a stalled transfer can
+// be told apart from a slow one.
+func (p *Progress) logLargeFiles(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		var lines []string
+		p.mu.Lock()
+		now := time.Now()
+		for i := range p.workers {
+			wp := &p.workers[i]
+			if wp.item == nil || wp.item.Size < p.LargeFileSize || now.Sub(wp.started) < interval {
+				continue
+			}
+			read := wp.read
+			if read > wp.item.Size {
+				read = wp.item.Size
+			}
+			lines = append(lines, fmt.Sprintf("%s: %d%%, %s of %s, %s/s",
+				wp.item, read*100/wp.item.Size, FormatSize(read), FormatSize(wp.item.Size),
+				FormatSize(Rate(wp.read-wp.lastRead, now.Sub(wp.lastTime)))))
+			wp.lastRead, wp.lastTime = wp.read, now
+		}
+		p.mu.Unlock()
+		// Logging can draw the progress bar, which needs the lock.
+		for _, line := range lines {
+			log.Print(line)
+		}
+	}
+}
+
+// ProgressState is a snapshot of a Progress, e.g. for
+// a progress bar or metrics.
+type ProgressState struct {
+	Stats                              TransferStats
+	Files, TotalFiles                  int64
+	Processed, TotalBytes, Transferred int64
+	// Done are the bytes of finished transfers.
+	Done int64
+	// Busy is the number of workers transferring an item.
+	Busy int
+	// Counting and Counted tell whether the totals are
+	// being counted and are complete (see Count).
+	Counting, Counted bool
+	Workers           []WorkerState
+	Elapsed           time.Duration
+}
+
+// WorkerState is a snapshot of what a worker is doing.
+// Item is nil if the worker is idle.
+type WorkerState struct {
+	Item    *Item
+	Started time.Time
+	Read    int64
+}
+
+// State returns a snapshot of the transfers.
+func (p *Progress) State() ProgressState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	running := p.running()
+	workers := make([]WorkerState, len(p.workers))
+	for i, wp := range p.workers {
+		workers[i] = WorkerState{wp.item, wp.started, wp.read}
+	}
+	return ProgressState{
+		Stats:       p.stats,
+		Files:       p.stats.Transferred + p.stats.Skipped + p.stats.Failed,
+		TotalFiles:  p.totalFiles,
+		Processed:   p.processed + running,
+		TotalBytes:  p.totalBytes,
+		Transferred: p.done + running,
+		Done:        p.done,
+		Busy:        p.busy(),
+		Counting:    p.counting,
+		Counted:     p.counted,
+		Workers:     workers,
+		Elapsed:     time.Since(p.start),
+	}
+}
+
+// Pause blocks the start of new transfers until Resume is called.
+// Running transfers are finished, as servers close connections whose
+// requests stall, e.g. S3 after about 20 seconds.
+func (p *Progress) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed == nil {
+		p.resumed = make(chan struct{})
+	}
+}
+
+func (p *Progress) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+	}
+}
+
+// TogglePause pauses the transfers or resumes paused ones and
+// reports whether they are paused now.
+func (p *Progress) TogglePause() bool {
+	p.mu.Lock()
+	paused := p.resumed != nil
+	p.mu.Unlock()
+	if paused {
+		p.Resume()
+	} else {
+		p.Pause()
+	}
+	return !paused
+}
+
+// wait blocks while the transfers are paused.
+func (p *Progress) wait() {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed != nil {
+		<-resumed
+	}
+}
+
+// Stats returns the number of items processed so far.
+func (p *Progress) Stats() TransferStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// bytes returns the number of bytes transferred so far.
+func (p *Progress) bytes() int64 {
+	return p.done + p.running()
+}
+
+// running returns the number of bytes read by running transfers.
+// Items may be read more than once (e.g. to calculate checksums),
+// so they count with at most their size.
+func (p *Progress) running() int64 {
+	var n int64
+	for _, wp := range p.workers {
+		if wp.item == nil {
+			continue
+		}
+		if wp.read < wp.item.Size {
+			n += wp.read
+		} else {
+			n += wp.item.Size
+		}
+	}
+	return n
+}
+
+// busy returns the number of workers transferring an item.
+func (p *Progress) busy() int {
+	n := 0
+	for _, wp := range p.workers {
+		if wp.item != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Print writes a report of the transfers to w in a single write,
+// so that it isn't interleaved with log messages.
+func (p *Progress) Print(w io.Writer) {
+	var buf bytes.Buffer
+	p.report(&buf)
+	w.Write(buf.Bytes())
+}
+
+func (p *Progress) report(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	elapsed := now.Sub(p.start)
+	transferred := p.bytes()
+	if p.resumed != nil {
+		fmt.Fprintf(w, "Paused\n")
+	}
+	fmt.Fprintf(w, "After %s: %d transferred, %d skipped, %d failed, %d in progress\n",
+		elapsed.Round(time.Second), p.stats.Transferred, p.stats.Skipped, p.stats.Failed, p.busy())
+	fmt.Fprintf(w, "%s transferred, currently %s/s, on average %s/s\n",
+		FormatSize(transferred), FormatSize(Rate(transferred-p.lastBytes, now.Sub(p.lastTime))), FormatSize(Rate(transferred, elapsed)))
+	for i, wp := range p.workers {
+		if wp.item == nil {
+			fmt.Fprintf(w, "  #%d: idle\n", i+1)
+			continue
+		}
+		read := wp.read
+		if read > wp.item.Size {
+			read = wp.item.Size
+		}
+		fmt.Fprintf(w, "  #%d: %s, %s of %s for %s\n",
+			i+1, wp.item, FormatSize(read), FormatSize(wp.item.Size), now.Sub(wp.started).Round(time.Second))
+	}
+	p.lastBytes, p.lastTime = transferred, now
+}
+
+// Rate returns the throughput of n bytes in d in bytes per second.
+func Rate(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stalledReader blocks its first read until released is closed.
+type stalledReader struct {
+	*strings.Reader
+	started, released chan struct{}
+}
+
+func (r *stalledReader) Read(b []byte) (int, error) {
+	if r.started != nil {
+		close(r.started)
+		r.started = nil
+		<-r.released
+	}
+	return r.Reader.Read(b)
+}
+
+func (r *stalledReader) Close() error { return nil }
+
+func TestPauseFinishesRunningTransfers(t *testing.T) {
+	started, released := make(chan struct{}), make(chan struct{})
+	items := make(chan *Item, 2)
+	items <- &Item{Path: "running", Size: 3, ReadCloser: &stalledReader{strings.NewReader("abc"), started, released}}
+	items <- &Item{Path: "queued", Size: 3, ReadCloser: &stalledReader{Reader: strings.NewReader("def")}}
+	close(items)
+
+	progress := NewProgress(1)
+	dst := &MemoryStorage{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		CopyItems(context.Background(), context.Background(), dst, items, CopyOptions{Concurrency: 1, Progress: progress})
+	}()
+	<-started
+	progress.Pause()
+	close(released)
+
+	deadline := time.Now().Add(time.Second)
+	for len(dst.Paths()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := dst.Paths(); !reflect.DeepEqual(got, []string{"running"}) {
+		t.Fatalf("Transferred %v while paused, want only the running transfer", got)
+	}
+	progress.Resume()
+	<-done
+	if got := dst.Paths(); !reflect.DeepEqual(got, []string{"queued", "running"}) {
+		t.Errorf("Transferred %v after resuming", got)
+	}
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// providerEndpoints maps the bucket URL schemes of S3-compatible
+// providers to the endpoint of a region.
+var providerEndpoints = map[string]func(region string) string{
+	// DigitalOcean Spaces
+	"do": func(region string) string {
+		return "https://" + region + ".digitaloceanspaces.com"
+	},
+	// Wasabi
+	"wasabi": func(region string) string {
+		return "https://s3." + region + ".wasabisys.com"
+	},
+	// Backblaze B2's S3-compatible API
+	"b2": func(region string) string {
+		return "https://s3." + region + ".backblazeb2.com"
+	},
+}
+
+// IsProviderBucket reports whether bucketUrl uses one of the
+// schemes in providerEndpoints.
+func IsProviderBucket(bucketUrl string) bool {
+	parts := strings.SplitN(bucketUrl, "://", 2)
+	return len(parts) == 2 && providerEndpoints[parts[0]] != nil
+}
+
+// ParseProviderBucket splits a bucket URL like `do://nyc3/some-bucket`
+// into the endpoint, region and name of the bucket.
+func ParseProviderBucket(bucketUrl string) (endpoint, region, bucket string, err error) {
+	parts := strings.SplitN(bucketUrl, "://", 2)
+	if len(parts) != 2 || providerEndpoints[parts[0]] == nil {
+		return "", "", "", fmt.Errorf("Unknown provider in %s", bucketUrl)
+	}
+	path := strings.Split(parts[1], "/")
+	if len(path) < 2 || path[0] == "" || path[1] == "" {
+		return "", "", "", fmt.Errorf("Bucket address must be of the form %s://<region>/<bucket>", parts[0])
+	}
+	return providerEndpoints[parts[0]](path[0]), path[0], path[1], nil
+}
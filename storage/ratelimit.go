@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by all connections.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Burst is the biggest chunk a single read should take from the bucket.
+func (rl *RateLimiter) Burst() int {
+	if rl.rate < 1 {
+		return 1
+	}
+	return int(rl.rate)
+}
+
+// WaitN takes n tokens from the bucket, blocking until the bucket
+// has recovered from the withdrawal.
+func (rl *RateLimiter) WaitN(n int) {
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	wait := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	rl.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// limitedConn draws the bytes read from and written to the
+// connection from rl.
+type limitedConn struct {
+	net.Conn
+	rl *RateLimiter
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > c.rl.Burst() {
+		p = p[:c.rl.Burst()]
+	}
+	n, err := c.Conn.Read(p)
+	c.rl.WaitN(n)
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > c.rl.Burst() {
+			chunk = chunk[:c.rl.Burst()]
+		}
+		c.rl.WaitN(len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Conn returns a connection that draws all bytes read from
+// and written to c from rl.
+func (rl *RateLimiter) Conn(c net.Conn) net.Conn {
+	return &limitedConn{c, rl}
+}
+
+// LimitTransport makes all connections of t draw from rl. The limit
+// applies to the bytes on the wire, so reading files to checksum
+// them isn't throttled.
+func LimitTransport(t *http.Transport, rl *RateLimiter) {
+	dial := t.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return rl.Conn(c), nil
+	}
+}
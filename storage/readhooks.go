@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"io"
+
+	"gopkg.in/amz.v1/s3"
+)
+
+// readHooks are called for the reads from the content of an item.
+// All of them are optional.
+type readHooks struct {
+	// read is called with the bytes read at off. ordered is false for
+	// the random access reads of multipart uploads, whose parts are
+	// read concurrently and in any order.
+	read func(b []byte, off int64, ordered bool)
+	// close is called before the content is closed.
+	close func()
+}
+
+// hookReads makes the content of item, once it is open, call hooks.
+// Content with random access keeps it, so that it can still be
+// uploaded in parts.
+func hookReads(item *Item, hooks readHooks) {
+	item.wrap(func(i *Item) {
+		hr := &hookedReader{ReadCloser: i.ReadCloser, hooks: hooks}
+		if ra, ok := i.ReadCloser.(s3.ReaderAtSeeker); ok {
+			i.ReadCloser = &hookedFile{hr, ra}
+		} else {
+			i.ReadCloser = hr
+		}
+	})
+}
+
+type hookedReader struct {
+	io.ReadCloser
+	hooks readHooks
+	// off is the offset of the next Read.
+	off int64
+}
+
+func (r *hookedReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if n > 0 && r.hooks.read != nil {
+		r.hooks.read(b[:n], r.off, true)
+	}
+	r.off += int64(n)
+	return n, err
+}
+
+func (r *hookedReader) Close() error {
+	if r.hooks.close != nil {
+		r.hooks.close()
+	}
+	return r.ReadCloser.Close()
+}
+
+type hookedFile struct {
+	*hookedReader
+	ra s3.ReaderAtSeeker
+}
+
+func (r *hookedFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.ra.ReadAt(b, off)
+	if n > 0 && r.hooks.read != nil {
+		r.hooks.read(b[:n], off, false)
+	}
+	return n, err
+}
+
+func (r *hookedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.ra.Seek(offset, whence)
+	if err == nil {
+		r.off = pos
+	}
+	return pos, err
+}
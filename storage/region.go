@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"gopkg.in/amz.v1/aws"
+)
+
+var s3EndpointRegion = regexp.MustCompile(`^https://s3[.-]([a-z0-9-]+)\.amazonaws\.com$`)
+
+// S3RegionByName returns the region called name. Regions unknown to
+// goamz get their endpoint from the usual naming scheme.
+func S3RegionByName(name string) aws.Region {
+	if region, ok := aws.Regions[name]; ok {
+		return region
+	}
+	return aws.Region{
+		Name:       name,
+		S3Endpoint: "https://s3." + name + ".amazonaws.com",
+	}
+}
+
+// DetectBucketRegion looks up the region of bucket. S3 reports it in
+// the `x-amz-bucket-region` header of any response for the bucket,
+// including redirects and access denied errors. The request is sent
+// with client, which mustn't follow redirects, though.
+func DetectBucketRegion(client *http.Client, bucket string) (string, error) {
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := c.Head("https://s3.amazonaws.com/" + bucket)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	region := resp.Header.Get("X-Amz-Bucket-Region")
+	if region == "" {
+		return "", fmt.Errorf("Could not detect region of bucket %s (%s)", bucket, resp.Status)
+	}
+	return region, nil
+}
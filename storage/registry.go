@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OpenOptions are passed to the backend opening a storage. Backends
+// ignore the options they don't support.
+type OpenOptions struct {
+	// Prefix is the path below the address the storage is rooted at.
+	Prefix string
+	// AccessKey and SecretKey are the keys of S3 buckets or the
+	// user and password of FTP and WebDAV servers.
+	AccessKey, SecretKey string
+	// Credentials is the service account key file for gs:// buckets.
+	Credentials string
+	// PreservePerms keeps the permissions of files written to file://.
+	PreservePerms bool
+	// Client, if set, sends the HTTP requests of the storage
+	// instead of a client of its own.
+	Client *http.Client
+}
+
+// client returns opts.Client if it is set, otherwise c.
+func (opts OpenOptions) client(c *http.Client) *http.Client {
+	if opts.Client != nil {
+		return opts.Client
+	}
+	return c
+}
+
+// Opener opens the storage at an address like `ftp://host/dir`.
+// On failure, the returned Storage must be nil, not a nil pointer.
+type Opener func(address string, opts OpenOptions) (Storage, error)
+
+var (
+	backendsMu sync.RWMutex
+	// backends maps URL schemes to the backend for their addresses.
+	backends = map[string]Opener{
+		"file":        openLocal,
+		"ftp":         openFTP,
+		"ftps":        openFTP,
+		"gs":          openGCS,
+		"gcs":         openGCSInterop,
+		"s3":          openS3,
+		"webdav":      openWebDAV,
+		"webdav+http": openWebDAV,
+	}
+)
+
+func init() {
+	for scheme := range providerEndpoints {
+		backends[scheme] = openProvider
+	}
+}
+
+// Register makes Open use open for addresses with the given scheme,
+// replacing the backend registered for it before, if any.
+func Register(scheme string, open Opener) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[scheme] = open
+}
+
+// Schemes returns the registered schemes in lexical order.
+func Schemes() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	var schemes []string
+	for scheme := range backends {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Registered reports whether a backend is registered
+// for the scheme of address.
+func Registered(address string) bool {
+	return opener(address) != nil
+}
+
+// Open opens the storage at address with the backend
+// registered for its scheme.
+func Open(address string, opts OpenOptions) (Storage, error) {
+	open := opener(address)
+	if open == nil {
+		return nil, fmt.Errorf("No storage backend for %s", address)
+	}
+	return open(address, opts)
+}
+
+func opener(address string) Opener {
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	return backends[parts[0]]
+}
+
+// openLocal mirrors to a local directory, e.g. to try out filters.
+func openLocal(address string, opts OpenOptions) (Storage, error) {
+	return &LocalStorage{
+		Prefix:        filepath.Join(strings.TrimPrefix(address, "file://"), opts.Prefix),
+		PreservePerms: opts.PreservePerms,
+	}, nil
+}
+
+func openFTP(address string, opts OpenOptions) (Storage, error) {
+	s, err := NewFTPStorage(address, opts.AccessKey, opts.SecretKey, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func openGCS(address string, opts OpenOptions) (Storage, error) {
+	s, err := NewGCSStorage(address, opts.Credentials, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.Client = opts.client(s.Client)
+	return s, nil
+}
+
+// openGCSInterop opens a GCS bucket through its S3-compatible API.
+func openGCSInterop(address string, opts OpenOptions) (Storage, error) {
+	bucket := strings.TrimPrefix(address, "gcs://")
+	s, err := NewGcsStorage(opts.AccessKey, opts.SecretKey, "https://"+bucket, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.Client = opts.client(s.Client)
+	return s, nil
+}
+
+func openS3(address string, opts OpenOptions) (Storage, error) {
+	bucket := strings.TrimPrefix(address, "s3://")
+	verbosef("Prefix: %s", bucket)
+	s, err := NewS3Storage(opts.AccessKey, opts.SecretKey, "https://"+bucket, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.Client = opts.client(s.Client)
+	return s, nil
+}
+
+func openWebDAV(address string, opts OpenOptions) (Storage, error) {
+	s, err := NewWebDAVStorage(address, opts.AccessKey, opts.SecretKey, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.Client = opts.client(s.Client)
+	return s, nil
+}
+
+// openProvider opens a bucket of an S3-compatible provider.
+func openProvider(address string, opts OpenOptions) (Storage, error) {
+	endpoint, region, bucket, err := ParseProviderBucket(address)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid bucket address: %s", err)
+	}
+	s, err := NewS3EndpointStorage(opts.AccessKey, opts.SecretKey, endpoint, region, bucket, opts.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	s.Client = opts.client(s.Client)
+	return s, nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/amz.v1/s3"
+)
+
+// Retrieval tiers of RestoreObject requests.
+var RestoreTiers = []string{"Standard", "Bulk", "Expedited"}
+
+// How often the status of pending restores is checked.
+const restorePollInterval = time.Minute
+
+// isArchived reports whether the object has to be restored
+// before it can be downloaded.
+func isArchived(key s3.Key) bool {
+	return key.StorageClass == "GLACIER" || key.StorageClass == "DEEP_ARCHIVE"
+}
+
+// restore requests a temporary copy of the archived object at key
+// that is kept for s.RestoreDays days.
+func (s *S3Storage) restore(ctx context.Context, key string) error {
+	var body bytes.Buffer
+	err := xml.NewEncoder(&body).Encode(struct {
+		XMLName xml.Name `xml:"RestoreRequest"`
+		Days    int
+		Tier    string `xml:"GlacierJobParameters>Tier"`
+	}{Days: s.RestoreDays, Tier: s.RestoreTier})
+	if err != nil {
+		return err
+	}
+	header := http.Header{"Content-Type": {"application/xml"}}
+	resp, err := s.request(ctx, "POST", key, url.Values{"restore": {""}}, header, &body, int64(body.Len()))
+	if s3err, ok := err.(*s3.Error); ok && s3err.Code == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// restored reports whether a restored copy of the object at key
+// is available.
+func (s *S3Storage) restored(ctx context.Context, key string) (bool, error) {
+	resp, err := s.request(ctx, "HEAD", key, nil, s.sseCustomerHeader(), nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	status := resp.Header.Get("X-Amz-Restore")
+	return strings.Contains(status, `ongoing-request="false"`), nil
+}
+
+// Restore initiates the restore of all archived objects below the
+// storage's prefix and prints their keys to w. If wait is set, it
+// returns once all of them can be downloaded or ctx is cancelled.
+func Restore(ctx context.Context, w io.Writer, s *S3Storage, wait bool) error {
+	objects, err := s.ListObjects(ctx)
+	if err != nil {
+		return err
+	}
+	var pending []string
+	var failed int
+	for _, obj := range objects {
+		if !isArchived(obj) {
+			continue
+		}
+		err := s.restore(ctx, obj.Key)
+		if err != nil {
+			log.Printf("Could not restore %s: %s", obj.Key, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "restoring: %s\n", obj.Key)
+		pending = append(pending, obj.Key)
+	}
+	for wait && len(pending) > 0 {
+		select {
+		case <-time.After(restorePollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		var stillPending []string
+		for _, key := range pending {
+			ok, err := s.restored(ctx, key)
+			if err != nil {
+				log.Printf("Could not check restore status of %s: %s", key, err)
+				failed++
+				continue
+			}
+			if !ok {
+				stillPending = append(stillPending, key)
+				continue
+			}
+			fmt.Fprintf(w, "restored:  %s\n", key)
+		}
+		pending = stillPending
+	}
+	if failed > 0 {
+		return fmt.Errorf("Could not restore %d objects", failed)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// PatternRule assigns a value to all paths matching a glob
+// pattern, which works like the patterns of --include and --exclude.
+type PatternRule struct {
+	Pattern string
+	Value   string
+}
+
+// ParsePatternRule parses a rule of the form `pattern=value`.
+func ParsePatternRule(s string) (PatternRule, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return PatternRule{}, fmt.Errorf("Invalid rule %q, must be of the form pattern=value", s)
+	}
+	return PatternRule{Pattern: parts[0], Value: parts[1]}, nil
+}
+
+func ParsePatternRules(ss []string) ([]PatternRule, error) {
+	var rules []PatternRule
+	for _, s := range ss {
+		rule, err := ParsePatternRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matchRules returns the value of the first rule matching relpath.
+func matchRules(rules []PatternRule, relpath string) (string, bool) {
+	for _, rule := range rules {
+		if (FilterRule{Pattern: rule.Pattern}).matches(relpath, false) {
+			return rule.Value, true
+		}
+	}
+	return "", false
+}
+
+// ParseHeaders parses headers of the form `Name: value`.
+func ParseHeaders(ss []string) (http.Header, error) {
+	header := http.Header{}
+	for _, s := range ss {
+		parts := strings.SplitN(s, ":", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			return nil, fmt.Errorf("Invalid header %q, must be of the form Name: value", s)
+		}
+		header.Add(name, strings.TrimSpace(parts[1]))
+	}
+	return header, nil
+}
+
+// ParseMetadata parses metadata of the form `key=value`.
+func ParseMetadata(ss []string) (map[string]string, error) {
+	metadata := map[string]string{}
+	for _, s := range ss {
+		parts := strings.SplitN(s, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("Invalid metadata %q, must be of the form key=value", s)
+		}
+		metadata[key] = parts[1]
+	}
+	return metadata, nil
+}
@@ -0,0 +1,31 @@
+package storage
+
+import "testing"
+
+func TestMatchRules(t *testing.T) {
+	rules, err := ParsePatternRules([]string{"*.html=no-cache", "/assets/*=max-age=31536000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		value string
+		ok    bool
+	}{
+		{"index.html", "no-cache", true},
+		{"assets/index.html", "no-cache", true},
+		{"assets/app.js", "max-age=31536000", true},
+		{"app.js", "", false},
+	}
+	for _, test := range tests {
+		value, ok := matchRules(rules, test.path)
+		if value != test.value || ok != test.ok {
+			t.Errorf("matchRules(%q) = %q, %v, want %q, %v", test.path, value, ok, test.value, test.ok)
+		}
+	}
+	for _, s := range []string{"no-equals", "=value"} {
+		if _, err := ParsePatternRule(s); err == nil {
+			t.Errorf("ParsePatternRule(%q) succeeded", s)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+	"gopkg.in/amz.v1/s3"
+)
+
+// request sends a signed request for key to the storage's bucket.
+// goamz doesn't allow setting arbitrary headers, which are needed to
+// attach metadata and the like to uploads, and only knows signature
+// version 2. Responses with a status other than 2xx are turned into
+// an *s3.Error. The request is aborted when ctx is cancelled.
+func (s *S3Storage) request(ctx context.Context, method, key string, params url.Values, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	u, err := url.Parse(s.bucket.Region.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	// Signature version 2 always signs the path-style resource.
+	resource := "/" + uriEscape(s.bucket.Name, false) + "/" + uriEscape(key, true)
+	if s.VirtualHosted {
+		u.Host = s.bucket.Name + "." + u.Host
+		u.Path = "/" + key
+		u.RawPath = "/" + uriEscape(key, true)
+	} else {
+		u.Path = "/" + s.bucket.Name + "/" + key
+		u.RawPath = resource
+	}
+	u.RawQuery = encodeParams(params)
+
+	if length == 0 {
+		// net/http would send a non-nil body of unknown length
+		// chunked, which S3 rejects.
+		body = http.NoBody
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = length
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	now := time.Now().UTC()
+	req.Header.Set("Date", now.Format(http.TimeFormat))
+	auth := s.bucket.Auth
+	if s.Credentials != nil {
+		keys, err := s.Credentials.Get()
+		if err != nil {
+			return nil, err
+		}
+		auth = aws.Auth{AccessKey: keys.AccessKey, SecretKey: keys.SecretKey}
+		if keys.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", keys.SessionToken)
+		}
+	}
+	if s.sigV2 {
+		signV2(req, resource, params, auth)
+	} else {
+		signV4(req, params, auth, s.bucket.Region.Name, "s3", now)
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		s3err := &s3.Error{StatusCode: resp.StatusCode}
+		xml.NewDecoder(resp.Body).Decode(s3err)
+		if s3err.Message == "" {
+			s3err.Message = resp.Status
+		}
+		return nil, s3err
+	}
+	return resp, nil
+}
+
+// requestXML sends a request and decodes the XML response into v.
+func (s *S3Storage) requestXML(ctx context.Context, method, key string, params url.Values, header http.Header, body []byte, v interface{}) error {
+	resp, err := s.request(ctx, method, key, params, header, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// list lists up to max objects below prefix, starting after marker.
+func (s *S3Storage) list(ctx context.Context, prefix, marker string, max int) (*s3.ListResp, error) {
+	params := url.Values{
+		"prefix":   {prefix},
+		"max-keys": {strconv.Itoa(max)},
+	}
+	if marker != "" {
+		params.Set("marker", marker)
+	}
+	resp := &s3.ListResp{}
+	err := s.requestXML(ctx, "GET", "", params, nil, nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// listMulti returns the unfinished multipart uploads below prefix.
+func (s *S3Storage) listMulti(ctx context.Context, prefix string) ([]*s3.Multi, error) {
+	var multis []*s3.Multi
+	params := url.Values{"uploads": {""}, "prefix": {prefix}}
+	for {
+		var result struct {
+			IsTruncated        bool
+			NextKeyMarker      string
+			NextUploadIdMarker string
+			Upload             []struct {
+				Key      string
+				UploadId string
+			}
+		}
+		err := s.requestXML(ctx, "GET", "", params, nil, nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		for _, upload := range result.Upload {
+			multis = append(multis, &s3.Multi{Bucket: s.bucket, Key: upload.Key, UploadId: upload.UploadId})
+		}
+		if !result.IsTruncated {
+			return multis, nil
+		}
+		params.Set("key-marker", result.NextKeyMarker)
+		params.Set("upload-id-marker", result.NextUploadIdMarker)
+	}
+}
+
+// listParts returns the parts that have been uploaded to m.
+func (s *S3Storage) listParts(ctx context.Context, m *s3.Multi) ([]s3.Part, error) {
+	var parts []s3.Part
+	params := url.Values{"uploadId": {m.UploadId}}
+	for {
+		var result struct {
+			IsTruncated          bool
+			NextPartNumberMarker string
+			Part                 []s3.Part
+		}
+		err := s.requestXML(ctx, "GET", m.Key, params, nil, nil, &result)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, result.Part...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		params.Set("part-number-marker", result.NextPartNumberMarker)
+	}
+}
+
+// complete assembles the uploaded parts of m into the final object.
+func (s *S3Storage) complete(ctx context.Context, m *s3.Multi, parts []s3.Part) error {
+	type completePart struct {
+		PartNumber int
+		ETag       string
+	}
+	var req struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Part    []completePart
+	}
+	for _, part := range parts {
+		req.Part = append(req.Part, completePart{part.N, part.ETag})
+	}
+	body, err := xml.Marshal(req)
+	if err != nil {
+		return err
+	}
+	// Errors can be reported with a 200 status after the
+	// response has started.
+	var result struct {
+		XMLName xml.Name
+		s3.Error
+	}
+	err = s.requestXML(ctx, "POST", m.Key, url.Values{"uploadId": {m.UploadId}}, nil, body, &result)
+	if err != nil {
+		return err
+	}
+	if result.XMLName.Local == "Error" {
+		result.Error.StatusCode = http.StatusOK
+		return &result.Error
+	}
+	return nil
+}
+
+// uriEscape escapes s the way AWS expects in canonical requests:
+// everything but unreserved characters (and optionally slashes)
+// is percent-encoded.
+func uriEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// encodeParams is like url.Values.Encode but leaves out the `=`
+// of empty parameters like `?uploads`.
+func encodeParams(params url.Values) string {
+	return encodeQuery(params, false)
+}
+
+// encodeQuery encodes params sorted by name and value. withEmpty
+// keeps the `=` of empty parameters as the canonical query of
+// signature version 4 requires.
+func encodeQuery(params url.Values, withEmpty bool) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), params[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			if value == "" && !withEmpty {
+				parts = append(parts, uriEscape(name, false))
+				continue
+			}
+			parts = append(parts, uriEscape(name, false)+"="+uriEscape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Query parameters that are part of the signed resource.
+var signedParams = map[string]bool{
+	"acl": true, "delete": true, "partNumber": true, "restore": true,
+	"select": true, "select-type": true, "tagging": true, "uploadId": true,
+	"uploads": true, "versionId": true, "versioning": true, "versions": true,
+}
+
+// signV2 adds an AWS signature version 2 for resource to req, which
+// is what Google Cloud Storage's interoperability API expects.
+func signV2(req *http.Request, resource string, params url.Values, auth aws.Auth) {
+	var amzHeaders []string
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") {
+			amzHeaders = append(amzHeaders, name+":"+strings.Join(values, ","))
+		}
+	}
+	sort.Strings(amzHeaders)
+
+	var subresources []string
+	for name := range params {
+		if !signedParams[name] {
+			continue
+		}
+		if v := params.Get(name); v != "" {
+			name += "=" + v
+		}
+		subresources = append(subresources, name)
+	}
+	sort.Strings(subresources)
+	if len(subresources) > 0 {
+		resource += "?" + strings.Join(subresources, "&")
+	}
+
+	payload := req.Method + "\n" +
+		req.Header.Get("Content-MD5") + "\n" +
+		req.Header.Get("Content-Type") + "\n" +
+		req.Header.Get("Date") + "\n"
+	for _, h := range amzHeaders {
+		payload += h + "\n"
+	}
+	payload += resource
+
+	mac := hmac.New(sha1.New, []byte(auth.SecretKey))
+	mac.Write([]byte(payload))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	req.Header.Set("Authorization", "AWS "+auth.AccessKey+":"+signature)
+}
+
+// signV4 adds an AWS signature version 4 to req, which all AWS
+// regions accept and the newer ones require. Unless req has an
+// X-Amz-Content-Sha256 header, the payload is not signed so that
+// bodies can be streamed. Only the parts of multipart uploads are sent
+// with a Content-MD5; single uploads are checked against the returned
+// ETag afterwards, which is not possible for encrypted objects (see
+// etagIsMD5).
+func signV4(req *http.Request, params url.Values, auth aws.Auth, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || strings.HasPrefix(name, "content-") || name == "range" {
+			for i := range values {
+				values[i] = strings.TrimSpace(values[i])
+			}
+			headers[name] = strings.Join(values, ",")
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := req.Method + "\n" +
+		req.URL.EscapedPath() + "\n" +
+		encodeQuery(params, true) + "\n" +
+		canonicalHeaders + "\n" +
+		signedHeaders + "\n" +
+		req.Header.Get("X-Amz-Content-Sha256")
+
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+
+	key := []byte("AWS4" + auth.SecretKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+auth.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Input formats of `select`.
+var SelectFormats = []string{"csv", "json", "jsonl"}
+
+// SelectOptions configure an S3 Select query.
+type SelectOptions struct {
+	Expression string
+	// Format is one of SelectFormats. If empty, it is
+	// derived from the object's extension.
+	Format string
+	// Header makes the first line of CSV input name the columns.
+	Header bool
+}
+
+// selectFormat derives the input format of key from its extension.
+func selectFormat(key string) string {
+	switch path.Ext(strings.TrimSuffix(key, ".gz")) {
+	case ".json":
+		return "json"
+	case ".jsonl", ".ndjson":
+		return "jsonl"
+	}
+	return "csv"
+}
+
+type selectCSV struct {
+	FileHeaderInfo string `xml:",omitempty"`
+}
+
+type selectJSON struct {
+	Type string `xml:",omitempty"`
+}
+
+type selectRequest struct {
+	XMLName         xml.Name `xml:"SelectObjectContentRequest"`
+	Expression      string
+	ExpressionType  string
+	CompressionType string      `xml:"InputSerialization>CompressionType"`
+	CSVInput        *selectCSV  `xml:"InputSerialization>CSV"`
+	JSONInput       *selectJSON `xml:"InputSerialization>JSON"`
+	CSVOutput       *selectCSV  `xml:"OutputSerialization>CSV"`
+	JSONOutput      *selectJSON `xml:"OutputSerialization>JSON"`
+}
+
+// Select runs the query in opts against the object at path relative
+// to the storage's prefix and writes the resulting records to w.
+// CSV input results in CSV records, JSON input in JSON lines.
+func Select(ctx context.Context, w io.Writer, s *S3Storage, p string, opts SelectOptions) error {
+	key := filepath.ToSlash(filepath.Join(s.prefix, p))
+	format := opts.Format
+	if format == "" {
+		format = selectFormat(key)
+	}
+	req := selectRequest{
+		Expression:      opts.Expression,
+		ExpressionType:  "SQL",
+		CompressionType: "NONE",
+	}
+	if strings.HasSuffix(key, ".gz") {
+		req.CompressionType = "GZIP"
+	}
+	switch format {
+	case "csv":
+		req.CSVInput = &selectCSV{FileHeaderInfo: "NONE"}
+		if opts.Header {
+			req.CSVInput.FileHeaderInfo = "USE"
+		}
+		req.CSVOutput = &selectCSV{}
+	case "json":
+		req.JSONInput = &selectJSON{Type: "DOCUMENT"}
+		req.JSONOutput = &selectJSON{}
+	case "jsonl":
+		req.JSONInput = &selectJSON{Type: "LINES"}
+		req.JSONOutput = &selectJSON{}
+	default:
+		return fmt.Errorf("Invalid format %s", format)
+	}
+	var body bytes.Buffer
+	err := xml.NewEncoder(&body).Encode(req)
+	if err != nil {
+		return err
+	}
+
+	header := s.sseCustomerHeader()
+	header.Set("Content-Type", "application/xml")
+	params := url.Values{"select": {""}, "select-type": {"2"}}
+	resp, err := s.request(ctx, "POST", key, params, header, &body, int64(body.Len()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	r := bufio.NewReader(resp.Body)
+	for {
+		headers, payload, err := readEventMessage(r)
+		if err != nil {
+			return err
+		}
+		if headers[":message-type"] == "error" {
+			return fmt.Errorf("%s: %s", headers[":error-code"], headers[":error-message"])
+		}
+		switch headers[":event-type"] {
+		case "Records":
+			_, err = w.Write(payload)
+			if err != nil {
+				return err
+			}
+		case "End":
+			return nil
+		}
+	}
+}
+
+var errEventCRC = errors.New("Invalid checksum in event stream")
+
+// readEventMessage reads a message in the event stream encoding
+// S3 Select responds with. Only string headers are returned.
+func readEventMessage(r io.Reader) (map[string]string, []byte, error) {
+	var prelude [12]byte
+	_, err := io.ReadFull(r, prelude[:])
+	if err == io.EOF {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	totalLength := binary.BigEndian.Uint32(prelude[0:4])
+	headersLength := binary.BigEndian.Uint32(prelude[4:8])
+	if crc32.ChecksumIEEE(prelude[:8]) != binary.BigEndian.Uint32(prelude[8:12]) {
+		return nil, nil, errEventCRC
+	}
+	if totalLength < 16 || headersLength > totalLength-16 {
+		return nil, nil, fmt.Errorf("Invalid event stream message length %d", totalLength)
+	}
+	msg := make([]byte, totalLength-12)
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	crc := crc32.Update(crc32.ChecksumIEEE(prelude[:]), crc32.IEEETable, msg[:len(msg)-4])
+	if crc != binary.BigEndian.Uint32(msg[len(msg)-4:]) {
+		return nil, nil, errEventCRC
+	}
+
+	headers := map[string]string{}
+	raw := msg[:headersLength]
+	for len(raw) > 0 {
+		nameLength := int(raw[0])
+		if len(raw) < 1+nameLength+3 {
+			return nil, nil, errors.New("Invalid event stream header")
+		}
+		name := string(raw[1 : 1+nameLength])
+		raw = raw[1+nameLength:]
+		// Type 7 is a string with a 16 bit length, which is
+		// the only type S3 Select uses.
+		if raw[0] != 7 {
+			return nil, nil, fmt.Errorf("Unsupported event stream header type %d", raw[0])
+		}
+		valueLength := int(binary.BigEndian.Uint16(raw[1:3]))
+		if len(raw) < 3+valueLength {
+			return nil, nil, errors.New("Invalid event stream header")
+		}
+		headers[name] = string(raw[3 : 3+valueLength])
+		raw = raw[3+valueLength:]
+	}
+	return headers, msg[headersLength : len(msg)-4], nil
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import "os/exec"
+
+// ShellCommand returns a command running command in the shell.
+func ShellCommand(command string) *exec.Cmd {
+	return exec.Command("/bin/sh", "-c", command)
+}
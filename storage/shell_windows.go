@@ -0,0 +1,8 @@
+package storage
+
+import "os/exec"
+
+// ShellCommand returns a command running command in cmd.exe.
+func ShellCommand(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
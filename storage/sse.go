@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// SSECustomerKeyEnv is the environment variable holding the
+// base64-encoded SSE-C key if no key file is given.
+const SSECustomerKeyEnv = "S3PUT_SSE_CUSTOMER_KEY"
+
+// LoadSSECustomerKey reads a 256 bit SSE-C key from path, either raw or
+// base64-encoded. If path is empty, the key is taken from the environment.
+// If there is no key at all, nil is returned.
+func LoadSSECustomerKey(path string) ([]byte, error) {
+	var data []byte
+	if path != "" {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data = []byte(os.Getenv(SSECustomerKeyEnv))
+		if len(data) == 0 {
+			return nil, nil
+		}
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Key must be 32 bytes, raw or base64-encoded")
+	}
+	return key, nil
+}
+
+// sseCustomerHeader returns the headers needed to write or read
+// objects encrypted with the customer-provided key.
+func (s *S3Storage) sseCustomerHeader() http.Header {
+	header := http.Header{}
+	if s.SSECustomerKey == nil {
+		return header
+	}
+	sum := md5.Sum(s.SSECustomerKey)
+	header.Set("x-amz-server-side-encryption-customer-algorithm", "AES256")
+	header.Set("x-amz-server-side-encryption-customer-key", base64.StdEncoding.EncodeToString(s.SSECustomerKey))
+	header.Set("x-amz-server-side-encryption-customer-key-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	return header
+}
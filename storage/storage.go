@@ -0,0 +1,1327 @@
+// Package storage implements the storages s3put transfers files
+// between and the transfers themselves, for use without the CLI.
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+	"gopkg.in/amz.v1/s3"
+)
+
+type Item struct {
+	Prefix string
+	Path   string
+	// Size is -1 if it is unknown until the content has been read,
+	// like that of compressed objects that are decompressed.
+	Size    int64
+	ModTime time.Time
+	Mode    os.FileMode
+	// ETag is the item's ETag if it originates from a bucket.
+	ETag string
+	// Metadata holds user metadata (x-amz-meta-*) without the prefix.
+	Metadata map[string]string
+	// Open, if set, opens the content of the item, which is nil
+	// until then. It is called right before the item is transferred,
+	// so that items waiting to be transferred (or skipped) don't hold
+	// a connection. It may also fill in metadata sent with the content.
+	// Reading the content fails once ctx is cancelled.
+	Open func(ctx context.Context, item *Item) error
+	io.ReadCloser
+}
+
+func (i *Item) String() string {
+	return fmt.Sprintf("(Prefix: %s) %s", i.Prefix, i.Path)
+}
+
+// open opens the content of the item if it hasn't been opened yet.
+func (i *Item) open(ctx context.Context) error {
+	if i.Open == nil {
+		return nil
+	}
+	open := i.Open
+	i.Open = nil
+	return open(ctx, i)
+}
+
+// wrap calls f once the content of the item is open, e.g. to wrap
+// its reader. Items that have been opened already are passed to f
+// right away.
+func (i *Item) wrap(f func(*Item)) {
+	if i.Open == nil {
+		f(i)
+		return
+	}
+	open := i.Open
+	i.Open = func(ctx context.Context, i *Item) error {
+		if err := open(ctx, i); err != nil {
+			return err
+		}
+		f(i)
+		return nil
+	}
+}
+
+// Close closes the content of the item, if it has been opened.
+func (i *Item) Close() error {
+	if i.ReadCloser == nil {
+		return nil
+	}
+	return i.ReadCloser.Close()
+}
+
+// ItemInfo is the metadata of a file as returned by Storage.Stat.
+type ItemInfo struct {
+	Size    int64
+	ModTime time.Time
+	// ETag is the ETag or checksum of the file if the storage
+	// has one without reading the file.
+	ETag        string
+	ContentType string
+}
+
+// Key returns the item's path relative to its prefix with forward
+// slashes, which is the same on both sides of a transfer.
+func (i *Item) Key() string {
+	return filepath.ToSlash(relativePath(i.Path, i.Prefix))
+}
+
+type Storage interface {
+	// Lists all files in the storage system. Any kind of
+	// chrooting/prefixing has to be implemented and enforced manually.
+	// Listing stops when ctx is cancelled. If the listing fails or
+	// files are left out because they couldn't be listed, the error
+	// is sent before the items channel is closed.
+	ListFiles(ctx context.Context) (<-chan *Item, <-chan error)
+	// Saves a file to the storage system. Any kind of
+	// chrooting/prefixing has to be implemented and enforced manually.
+	// The transfer is aborted when ctx is cancelled.
+	PutFile(ctx context.Context, item *Item) error
+	// Returns the metadata of the file at path, relative to the
+	// storage's prefix, or nil if there is no such file. The lookup
+	// is aborted when ctx is cancelled.
+	Stat(ctx context.Context, path string) (*ItemInfo, error)
+}
+
+// PathLister is implemented by storages that can list
+// only the files at the given paths.
+type PathLister interface {
+	ListPaths(ctx context.Context, paths []string) (<-chan *Item, <-chan error)
+}
+
+// StatLister is implemented by storages that can list their files
+// without opening them, to count them before transferring. The items
+// have no content. A nil channel means they can't be listed that way.
+type StatLister interface {
+	StatFiles(ctx context.Context) <-chan *Item
+}
+
+// listItems runs list in a goroutine with the channel it sends items
+// to, which is closed once list returns. The error list returns, if
+// any, is sent on the error channel before that.
+func listItems(list func(c chan<- *Item) error) (<-chan *Item, <-chan error) {
+	c := make(chan *Item)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		if err := list(c); err != nil {
+			errc <- err
+		}
+		close(c)
+	}()
+	return c, errc
+}
+
+// skippedFiles is the error of a listing that went on after
+// n files or directories couldn't be listed, or nil if n is 0.
+func skippedFiles(n int) error {
+	if n == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d files or directories could not be listed", n)
+}
+
+// sendItem sends item to c unless ctx is cancelled first, in which
+// case item is closed and false is returned.
+func sendItem(ctx context.Context, c chan<- *Item, item *Item) bool {
+	select {
+	case c <- item:
+		return true
+	case <-ctx.Done():
+		item.Close()
+		return false
+	}
+}
+
+// contextReader fails reads once ctx is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type S3Storage struct {
+	bucket *s3.Bucket
+	prefix string
+	// sigV2 signs requests with signature version 2 instead of 4.
+	sigV2 bool
+	// Client sends the requests to the bucket.
+	Client *http.Client
+	// VirtualHosted addresses the bucket as a subdomain of the
+	// endpoint instead of as the first path component.
+	VirtualHosted bool
+	// Credentials, if set, provide the keys requests are signed with
+	// instead of the ones the storage has been created with.
+	Credentials *AWSCredentials
+	// ACL is the canned ACL applied to uploaded objects.
+	ACL s3.ACL
+	// StorageClass is the storage class of uploaded objects.
+	// If empty, the bucket's default is used.
+	StorageClass string
+	// SSEKMSKeyId is the ID or ARN of the KMS key used to encrypt
+	// uploaded objects. If empty, KMS encryption is not requested.
+	SSEKMSKeyId string
+	// SSECustomerKey is the 256 bit key used to encrypt uploaded
+	// and decrypt downloaded objects (SSE-C).
+	SSECustomerKey []byte
+	// CacheControl is the Cache-Control header of uploaded objects
+	// that none of the CacheControlRules match.
+	CacheControl string
+	// CacheControlRules set the Cache-Control header of uploaded
+	// objects by their path. The first matching rule is applied.
+	CacheControlRules []PatternRule
+	// Header contains additional headers sent with every upload.
+	Header http.Header
+	// Metadata is added to every uploaded object's user metadata.
+	Metadata map[string]string
+	// Gzip enables compressing uploads with gzip. If GzipPatterns
+	// is not empty, only files matching one of them are compressed.
+	Gzip         bool
+	GzipPatterns []string
+	// KeepCompressed disables decompressing downloaded
+	// objects that have been stored with gzip encoding.
+	KeepCompressed bool
+	// ContentDisposition is the Content-Disposition header of uploaded
+	// objects. `{filename}` is replaced with the file's name.
+	ContentDisposition string
+	// Expires is the Expires header of uploaded objects, if not zero.
+	Expires time.Time
+	// ContentType overrides the Content-Type of uploaded objects,
+	// which is otherwise derived from their extension.
+	ContentType string
+	// TagFilter restricts listings to objects with matching tags.
+	TagFilter TagFilter
+	// VersionId and AsOf select an older version of the objects
+	// to get from a versioned bucket.
+	VersionId string
+	AsOf      time.Time
+	// RestoreDays and RestoreTier configure restores of archived objects.
+	RestoreDays int
+	RestoreTier string
+}
+
+var CannedACLs = []s3.ACL{
+	s3.Private,
+	s3.PublicRead,
+	s3.PublicReadWrite,
+	s3.AuthenticatedRead,
+	s3.BucketOwnerRead,
+	s3.BucketOwnerFull,
+	"aws-exec-read",
+}
+
+var StorageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"GLACIER_IR",
+	"DEEP_ARCHIVE",
+}
+
+func NewS3Storage(accessKey, secretKey, bucketUrl string, prefix string) (*S3Storage, error) {
+	auth := aws.Auth{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+	u, err := url.Parse(bucketUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketname := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	region, err := s3RegionByEndpoint(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return nil, err
+	}
+	s3i := s3.New(auth, region)
+	b := s3i.Bucket(bucketname)
+	return &S3Storage{
+		bucket: b,
+		prefix: prefix,
+		Client: NewHTTPClient(),
+		ACL:    s3.PublicRead,
+	}, nil
+}
+
+// NewS3EndpointStorage is like NewS3Storage for S3-compatible servers
+// like MinIO or Ceph RGW that are not in goamz's list of regions.
+func NewS3EndpointStorage(accessKey, secretKey, endpoint, region, bucketname, prefix string) (*S3Storage, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid endpoint %s", endpoint)
+	}
+	auth := aws.Auth{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+	s3i := s3.New(auth, aws.Region{
+		Name:       region,
+		S3Endpoint: strings.TrimSuffix(endpoint, "/"),
+	})
+	return &S3Storage{
+		bucket: s3i.Bucket(bucketname),
+		prefix: prefix,
+		Client: NewHTTPClient(),
+		ACL:    s3.PublicRead,
+	}, nil
+}
+
+func (s *S3Storage) ListFiles(ctx context.Context) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		if s.VersionId != "" || !s.AsOf.IsZero() {
+			return s.listVersions(ctx, []string{s.prefix}, c)
+		}
+		marker := ""
+		skipped := 0
+		for {
+			resp, err := s.list(ctx, s.prefix, marker, 1000)
+			if err != nil {
+				return fmt.Errorf("Could not list items in bucket %s: %s", s.bucket.Name, err)
+			}
+			for _, item := range resp.Contents {
+				marker = item.Key
+				if ok, err := s.matchesTags(ctx, item.Key, ""); err != nil || !ok {
+					if err != nil {
+						log.Printf("Could not get tags of %s: %s", item.Key, err)
+						skipped++
+					}
+					continue
+				}
+				if !sendItem(ctx, c, s.lazyItem(item, "")) {
+					return nil
+				}
+			}
+			if !resp.IsTruncated {
+				return skippedFiles(skipped)
+			}
+		}
+	})
+}
+
+// StatFiles is like ListFiles, but doesn't download the objects.
+// Older versions can't be listed this way. Errors are left to be
+// reported by ListFiles.
+func (s *S3Storage) StatFiles(ctx context.Context) <-chan *Item {
+	if s.VersionId != "" || !s.AsOf.IsZero() {
+		return nil
+	}
+	c := make(chan *Item)
+	go func() {
+		marker := ""
+		defer close(c)
+		for {
+			resp, err := s.list(ctx, s.prefix, marker, 1000)
+			if err != nil {
+				return
+			}
+			for _, key := range resp.Contents {
+				marker = key.Key
+				if ok, err := s.matchesTags(ctx, key.Key, ""); err != nil || !ok {
+					continue
+				}
+				item := s.keyItem(key)
+				item.ReadCloser = http.NoBody
+				if !sendItem(ctx, c, item) {
+					return
+				}
+			}
+			if !resp.IsTruncated {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// ListPaths is like ListFiles but only lists the objects at the given
+// paths relative to the storage's prefix.
+func (s *S3Storage) ListPaths(ctx context.Context, paths []string) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		if s.VersionId != "" || !s.AsOf.IsZero() {
+			var keys []string
+			for _, path := range paths {
+				keys = append(keys, filepath.ToSlash(filepath.Join(s.prefix, path)))
+			}
+			return s.listVersions(ctx, keys, c)
+		}
+		skipped := 0
+		for _, path := range paths {
+			key := filepath.ToSlash(filepath.Join(s.prefix, path))
+			resp, err := s.list(ctx, key, "", 1)
+			if err != nil {
+				log.Printf("Could not look up %s: %s", key, err)
+				skipped++
+				continue
+			}
+			if len(resp.Contents) == 0 || resp.Contents[0].Key != key {
+				log.Printf("Could not find %s", key)
+				skipped++
+				continue
+			}
+			if ok, err := s.matchesTags(ctx, key, ""); err != nil || !ok {
+				if err != nil {
+					log.Printf("Could not get tags of %s: %s", key, err)
+					skipped++
+				}
+				continue
+			}
+			if !sendItem(ctx, c, s.lazyItem(resp.Contents[0], "")) {
+				return nil
+			}
+		}
+		return skippedFiles(skipped)
+	})
+}
+
+// lazyItem returns an item for the object at key (or a specific
+// version of it) that downloads it once it is opened.
+func (s *S3Storage) lazyItem(key s3.Key, versionId string) *Item {
+	item := s.keyItem(key)
+	item.Open = func(ctx context.Context, item *Item) error {
+		return s.openItem(ctx, item, key, versionId)
+	}
+	return item
+}
+
+// openItem downloads the object at key into item and
+// takes its metadata from the response.
+func (s *S3Storage) openItem(ctx context.Context, item *Item, key s3.Key, versionId string) error {
+	header := s.sseCustomerHeader()
+	// Keep net/http from decompressing transparently.
+	header.Set("Accept-Encoding", "identity")
+	var params url.Values
+	if versionId != "" {
+		params = url.Values{"versionId": {versionId}}
+	}
+	resp, err := s.request(ctx, "GET", key.Key, params, header, nil, 0)
+	if s3err, ok := err.(*s3.Error); ok && s3err.Code == "InvalidObjectState" {
+		return fmt.Errorf("Object is archived in %s, restore it first (see `restore`)", key.StorageClass)
+	}
+	if err != nil {
+		return err
+	}
+	item.Metadata = map[string]string{}
+	for name := range resp.Header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			item.Metadata[strings.ToLower(strings.TrimPrefix(name, "X-Amz-Meta-"))] = resp.Header.Get(name)
+		}
+	}
+	if mode, err := strconv.ParseUint(item.Metadata["mode"], 8, 32); err == nil {
+		item.Mode = os.FileMode(mode).Perm()
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" && !s.KeepCompressed {
+		body, err := gunzip(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return err
+		}
+		// The size of the listing is the compressed one.
+		item.Size = -1
+		if size, err := strconv.ParseInt(item.Metadata[metaUncompressedSize], 10, 64); err == nil {
+			item.Size = size
+		}
+		// Don't pass them on to storages that don't compress.
+		delete(item.Metadata, metaUncompressedSize)
+		delete(item.Metadata, metaUncompressedMD5)
+		item.ReadCloser = body
+		return nil
+	}
+	item.ReadCloser = resp.Body
+	return nil
+}
+
+const (
+	// Files at least this big are uploaded in parts so that an
+	// interrupted upload can be resumed.
+	multipartThreshold = 64 * 1024 * 1024
+	multipartPartSize  = 16 * 1024 * 1024
+)
+
+// ListObjects returns all objects below the storage's prefix
+// without fetching their contents.
+func (s *S3Storage) ListObjects(ctx context.Context) ([]s3.Key, error) {
+	var keys []s3.Key
+	marker := ""
+	for {
+		resp, err := s.list(ctx, s.prefix, marker, 1000)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, resp.Contents...)
+		if !resp.IsTruncated || len(resp.Contents) == 0 {
+			return keys, nil
+		}
+		marker = resp.Contents[len(resp.Contents)-1].Key
+	}
+}
+
+func (s *S3Storage) key(item *Item) string {
+	path := strings.TrimPrefix(item.Path, item.Prefix)
+	return filepath.Join(s.prefix, path)
+}
+
+// stat returns the metadata of the object item would be stored as
+// or nil if there is no such object.
+func (s *S3Storage) stat(ctx context.Context, item *Item) (*Item, error) {
+	key := s.key(item)
+	resp, err := s.list(ctx, key, "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Contents) == 0 || resp.Contents[0].Key != key {
+		return nil, nil
+	}
+	existing := s.keyItem(resp.Contents[0])
+	if s.shouldGzip(item) {
+		return s.uncompressedItem(ctx, key, existing)
+	}
+	return existing, nil
+}
+
+// Stat looks up the object at path with a HEAD request.
+func (s *S3Storage) Stat(ctx context.Context, path string) (*ItemInfo, error) {
+	key := filepath.ToSlash(filepath.Join(s.prefix, path))
+	resp, err := s.request(ctx, "HEAD", key, nil, s.sseCustomerHeader(), nil, 0)
+	if s3err, ok := err.(*s3.Error); ok && s3err.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ItemInfo{
+		Size:        resp.ContentLength,
+		ModTime:     modTime,
+		ETag:        normalizeETag(resp.Header.Get("ETag")),
+		ContentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+func (s *S3Storage) keyItem(key s3.Key) *Item {
+	modTime, _ := time.Parse(time.RFC3339, key.LastModified)
+	return &Item{
+		Prefix:  s.prefix,
+		Path:    key.Key,
+		Size:    key.Size,
+		ModTime: modTime,
+		ETag:    normalizeETag(key.ETag),
+	}
+}
+
+func (s *S3Storage) PutFile(ctx context.Context, item *Item) error {
+	defer item.Close()
+	key := s.key(item)
+	header, err := s.uploadHeader(item)
+	if err != nil {
+		return err
+	}
+	if s.shouldGzip(item) {
+		size := item.Size
+		gzitem, sum, err := gzipItem(item)
+		if err != nil {
+			return err
+		}
+		defer gzitem.Close()
+		item = gzitem
+		header.Set("Content-Encoding", "gzip")
+		header.Set("x-amz-meta-"+metaUncompressedSize, strconv.FormatInt(size, 10))
+		header.Set("x-amz-meta-"+metaUncompressedMD5, sum)
+	}
+	if r, ok := item.ReadCloser.(s3.ReaderAtSeeker); ok && item.Size >= multipartThreshold {
+		err := s.putMulti(ctx, key, r, item.Size, header)
+		if err != nil || !s.etagIsMD5() {
+			return err
+		}
+		etag, err := multipartETag(r, item.Size, multipartPartSize)
+		if err != nil {
+			return err
+		}
+		return s.verify(ctx, key, etag)
+	}
+	h := md5.New()
+	resp, err := s.request(ctx, "PUT", key, nil, header, io.TeeReader(item, h), item.Size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	etag, remote := hex.EncodeToString(h.Sum(nil)), normalizeETag(resp.Header.Get("ETag"))
+	if s.etagIsMD5() && remote != etag {
+		return fmt.Errorf("Checksum mismatch for %s: local %s, remote %s", key, etag, remote)
+	}
+	return nil
+}
+
+// etagIsMD5 reports whether the ETags of uploaded objects are MD5 sums
+// of their content, which is not the case for KMS- or SSE-C-encrypted
+// objects.
+func (s *S3Storage) etagIsMD5() bool {
+	return s.SSEKMSKeyId == "" && s.SSECustomerKey == nil
+}
+
+func (s *S3Storage) contentType(item *Item) (string, error) {
+	if s.ContentType != "" {
+		return s.ContentType, nil
+	}
+	if contType := mime.TypeByExtension(filepath.Ext(item.Path)); contType != "" {
+		return contType, nil
+	}
+	return sniffContentType(item)
+}
+
+// uploadHeader returns the headers to send along with the upload of item.
+func (s *S3Storage) uploadHeader(item *Item) (http.Header, error) {
+	header := s.sseCustomerHeader()
+	header.Set("x-amz-acl", string(s.ACL))
+	if s.StorageClass != "" {
+		header.Set("x-amz-storage-class", s.StorageClass)
+	}
+	if s.SSEKMSKeyId != "" {
+		header.Set("x-amz-server-side-encryption", "aws:kms")
+		header.Set("x-amz-server-side-encryption-aws-kms-key-id", s.SSEKMSKeyId)
+	}
+	contType, err := s.contentType(item)
+	if err != nil {
+		return nil, err
+	}
+	if contType != "" {
+		header.Set("Content-Type", contType)
+	}
+	if s.ContentDisposition != "" {
+		header.Set("Content-Disposition", strings.Replace(s.ContentDisposition, "{filename}", filepath.Base(item.Path), -1))
+	}
+	if !s.Expires.IsZero() {
+		header.Set("Expires", s.Expires.UTC().Format(http.TimeFormat))
+	}
+	relpath := filepath.ToSlash(relativePath(item.Path, item.Prefix))
+	cacheControl := s.CacheControl
+	if rule, ok := matchRules(s.CacheControlRules, relpath); ok {
+		cacheControl = rule
+	}
+	if cacheControl != "" {
+		header.Set("Cache-Control", cacheControl)
+	}
+	for name, value := range item.Metadata {
+		header.Set("x-amz-meta-"+name, value)
+	}
+	for name, value := range s.Metadata {
+		header.Set("x-amz-meta-"+name, value)
+	}
+	if item.Mode != 0 {
+		header.Set("x-amz-meta-mode", fmt.Sprintf("%#o", item.Mode.Perm()))
+	}
+	for name, values := range s.Header {
+		header[name] = values
+	}
+	return header, nil
+}
+
+// verify compares the ETag of the object stored at key
+// with the locally calculated one.
+func (s *S3Storage) verify(ctx context.Context, key, etag string) error {
+	resp, err := s.list(ctx, key, "", 1)
+	if err != nil {
+		return fmt.Errorf("Could not verify %s: %s", key, err)
+	}
+	if len(resp.Contents) == 0 || resp.Contents[0].Key != key {
+		return fmt.Errorf("Could not verify %s: Object not found after upload", key)
+	}
+	remote := normalizeETag(resp.Contents[0].ETag)
+	if remote != etag {
+		return fmt.Errorf("Checksum mismatch for %s: local %s, remote %s", key, etag, remote)
+	}
+	return nil
+}
+
+// putMulti uploads r using a multipart upload. If there already is an
+// unfinished multipart upload for key (e.g. from a previous, crashed run),
+// it is continued and parts that have already been uploaded with the
+// same content are not sent again.
+func (s *S3Storage) putMulti(ctx context.Context, key string, r s3.ReaderAtSeeker, size int64, header http.Header) error {
+	m, err := s.multi(ctx, key, header)
+	if err != nil {
+		return err
+	}
+	parts, err := s.putParts(ctx, m, r, size)
+	if err != nil {
+		// The upload is deliberately not aborted (not even when
+		// interrupted) so the next run can pick it up again.
+		return err
+	}
+	return s.complete(ctx, m, parts)
+}
+
+// putParts uploads r in parts of multipartPartSize, reusing parts
+// that have already been uploaded to m if their checksum matches.
+func (s *S3Storage) putParts(ctx context.Context, m *s3.Multi, r s3.ReaderAtSeeker, size int64) ([]s3.Part, error) {
+	uploaded, err := s.listParts(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	existing := map[int]s3.Part{}
+	for _, part := range uploaded {
+		existing[part.N] = part
+	}
+
+	var parts []s3.Part
+	for n, offset := 1, int64(0); offset < size; n, offset = n+1, offset+multipartPartSize {
+		section := io.NewSectionReader(r, offset, multipartPartSize)
+		h := md5.New()
+		_, err := io.Copy(h, section)
+		if err != nil {
+			return nil, err
+		}
+		sum := h.Sum(nil)
+		if part, ok := existing[n]; ok && part.Size == section.Size() && normalizeETag(part.ETag) == hex.EncodeToString(sum) {
+			verbosef("Part %d of %s already uploaded", n, m.Key)
+			parts = append(parts, part)
+			continue
+		}
+
+		header := s.sseCustomerHeader()
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+		params := url.Values{
+			"partNumber": {strconv.Itoa(n)},
+			"uploadId":   {m.UploadId},
+		}
+		section.Seek(0, io.SeekStart)
+		resp, err := s.request(ctx, "PUT", m.Key, params, header, section, section.Size())
+		if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+		verbosef("Uploaded part %d of %s", n, m.Key)
+		parts = append(parts, s3.Part{N: n, ETag: resp.Header.Get("ETag"), Size: section.Size()})
+	}
+	return parts, nil
+}
+
+// multi returns the unfinished multipart upload for key
+// or initiates a new one with the given headers.
+func (s *S3Storage) multi(ctx context.Context, key string, header http.Header) (*s3.Multi, error) {
+	multis, err := s.listMulti(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range multis {
+		if m.Key == key {
+			return m, nil
+		}
+	}
+	resp, err := s.request(ctx, "POST", key, url.Values{"uploads": {""}}, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.Multi{Bucket: s.bucket, Key: key, UploadId: result.UploadId}, nil
+}
+
+func NewGcsStorage(accessKey, secretKey, bucketUrl string, prefix string) (*S3Storage, error) {
+	auth := aws.Auth{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+	u, err := url.Parse(bucketUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketname := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)[0]
+	region, err := gcsRegionByEndpoint(u.Scheme + "://" + u.Host)
+	if err != nil {
+		return nil, err
+	}
+	s3i := s3.New(auth, region)
+	b := s3i.Bucket(bucketname)
+	return &S3Storage{
+		bucket: b,
+		prefix: prefix,
+		sigV2:  true,
+		Client: NewHTTPClient(),
+		ACL:    s3.PublicRead,
+	}, nil
+}
+
+type LocalStorage struct {
+	Prefix string
+	// MaxDepth limits how many directory levels below Prefix
+	// ListFiles descends into. 0 means no limit.
+	MaxDepth int
+	// ExcludeHidden makes ListFiles skip files and
+	// directories whose name starts with a dot.
+	ExcludeHidden bool
+	Symlinks      SymlinkPolicy
+	// PreservePerms makes PutFile apply the permissions and
+	// ownership stored in an item's metadata.
+	PreservePerms bool
+
+	// statOnly makes ListFiles list files without opening them.
+	statOnly bool
+}
+
+// SymlinkPolicy decides how ListFiles treats symlinks.
+type SymlinkPolicy int
+
+const (
+	// Upload the targets of symlinks to files,
+	// skip symlinks to directories.
+	SymlinkFiles SymlinkPolicy = iota
+	// Skip all symlinks.
+	SymlinkSkip
+	// Follow all symlinks, skipping those that would
+	// lead into a cycle.
+	SymlinkFollow
+)
+
+func (s *LocalStorage) ListFiles(ctx context.Context) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		newprefix, err := filepath.Abs(s.Prefix)
+		if err != nil {
+			return fmt.Errorf("Path %s could not be made absolute: %s", s.Prefix, err)
+		}
+		f, err := os.Open(newprefix)
+		if err != nil {
+			return fmt.Errorf("Could not open %s: %s", newprefix, err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("Could not stat %s: %s", newprefix, err)
+		}
+		if !fi.IsDir() {
+			var r io.ReadCloser = f
+			if s.statOnly {
+				f.Close()
+				r = http.NoBody
+			}
+			sendItem(ctx, c, &Item{
+				Prefix:     filepath.Dir(newprefix),
+				Path:       newprefix,
+				Size:       fi.Size(),
+				ModTime:    fi.ModTime(),
+				Mode:       fi.Mode(),
+				Metadata:   ownerMetadata(fi),
+				ReadCloser: r,
+			})
+			return nil
+		}
+		f.Close()
+		ignore, err := ReadIgnoreFile(filepath.Join(newprefix, IgnoreFileName))
+		if err != nil {
+			return fmt.Errorf("Could not read %s: %s", IgnoreFileName, err)
+		}
+		s.infof("Traversing %s...", newprefix)
+		skipped := 0
+		if !s.walk(ctx, newprefix, newprefix, ignore, []os.FileInfo{fi}, c, &skipped) {
+			return nil
+		}
+		return skippedFiles(skipped)
+	})
+}
+
+// StatFiles is like ListFiles, but doesn't open the files.
+func (s *LocalStorage) StatFiles(ctx context.Context) <-chan *Item {
+	stat := *s
+	stat.statOnly = true
+	items, _ := stat.ListFiles(ctx)
+	return items
+}
+
+// logf logs problems with the listing, unless it is a listing
+// without content, as ListFiles will report them again.
+func (s *LocalStorage) logf(format string, args ...interface{}) {
+	if !s.statOnly {
+		log.Printf(format, args...)
+	}
+}
+
+// infof is like logf for informational messages.
+func (s *LocalStorage) infof(format string, args ...interface{}) {
+	if !s.statOnly {
+		infof(format, args...)
+	}
+}
+
+// walk sends all files below dir to c. parents contains dir and all
+// its parent directories to detect cycles when following symlinks.
+// Files and directories that can't be read are counted in skipped.
+// It returns false if ctx has been cancelled.
+func (s *LocalStorage) walk(ctx context.Context, root, dir string, ignore Filter, parents []os.FileInfo, c chan<- *Item, skipped *int) bool {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		s.logf("Could not read directory %s: %s", dir, err)
+		*skipped++
+		return true
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if info.Mode()&os.ModeSymlink != 0 {
+			if s.Symlinks == SymlinkSkip {
+				continue
+			}
+			target, err := os.Stat(path)
+			if err != nil {
+				s.logf("Skipping broken symlink %s: %s", path, err)
+				continue
+			}
+			if target.IsDir() && s.Symlinks != SymlinkFollow {
+				s.logf("Skipping symlinked directory %s", path)
+				continue
+			}
+			info = target
+		}
+
+		relpath := filepath.ToSlash(relativePath(path, root))
+		depth := strings.Count(relpath, "/") + 1
+		hidden := s.ExcludeHidden && strings.HasPrefix(filepath.Base(path), ".")
+		if info.IsDir() {
+			if hidden || !ignore.MatchDir(relpath) || (s.MaxDepth > 0 && depth >= s.MaxDepth) {
+				continue
+			}
+			if isParent(info, parents) {
+				s.logf("Skipping %s, symlink cycle", path)
+				continue
+			}
+			if !s.walk(ctx, root, path, ignore, append(parents, info), c, skipped) {
+				return false
+			}
+			continue
+		}
+		if hidden || !ignore.Match(relpath) {
+			continue
+		}
+		var r io.ReadCloser = http.NoBody
+		if !s.statOnly {
+			f, err := os.Open(path)
+			if err != nil {
+				log.Printf("Could not open %s: %s", path, err)
+				*skipped++
+				continue
+			}
+			r = f
+		}
+		item := &Item{
+			Prefix:     root,
+			Path:       path,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+			Mode:       info.Mode(),
+			Metadata:   ownerMetadata(info),
+			ReadCloser: r,
+		}
+		if !sendItem(ctx, c, item) {
+			return false
+		}
+	}
+	return true
+}
+
+// ownerMetadata records the owner and group of a file as metadata.
+func ownerMetadata(fi os.FileInfo) map[string]string {
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		return nil
+	}
+	return map[string]string{
+		"uid": strconv.Itoa(uid),
+		"gid": strconv.Itoa(gid),
+	}
+}
+
+func isParent(dir os.FileInfo, parents []os.FileInfo) bool {
+	for _, parent := range parents {
+		if os.SameFile(dir, parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListPaths is like ListFiles but only lists the files at the given
+// paths relative to the storage's prefix.
+func (s *LocalStorage) ListPaths(ctx context.Context, paths []string) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		root, err := filepath.Abs(s.Prefix)
+		if err != nil {
+			return fmt.Errorf("Path %s could not be made absolute: %s", s.Prefix, err)
+		}
+		skipped := 0
+		for _, path := range paths {
+			path = filepath.Join(root, path)
+			f, err := os.Open(path)
+			if err != nil {
+				log.Printf("Could not open %s: %s", path, err)
+				skipped++
+				continue
+			}
+			fi, err := f.Stat()
+			if err != nil || fi.IsDir() {
+				log.Printf("Skipping %s, not a file", path)
+				f.Close()
+				skipped++
+				continue
+			}
+			item := &Item{
+				Prefix:     root,
+				Path:       path,
+				Size:       fi.Size(),
+				ModTime:    fi.ModTime(),
+				Mode:       fi.Mode(),
+				Metadata:   ownerMetadata(fi),
+				ReadCloser: f,
+			}
+			if !sendItem(ctx, c, item) {
+				return nil
+			}
+		}
+		return skippedFiles(skipped)
+	})
+}
+
+func (s *LocalStorage) path(item *Item) string {
+	itempath := strings.TrimPrefix(item.Path, item.Prefix)
+	return filepath.Join(s.Prefix, itempath)
+}
+
+// stat returns the metadata of the file item would be stored as
+// or nil if there is no such file.
+func (s *LocalStorage) stat(ctx context.Context, item *Item) (*Item, error) {
+	path := s.path(item)
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Item{
+		Prefix:  s.Prefix,
+		Path:    path,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}, nil
+}
+
+// Stat looks up the file at path. Local files have no ETag and their
+// content type is guessed from the extension.
+func (s *LocalStorage) Stat(ctx context.Context, path string) (*ItemInfo, error) {
+	fi, err := os.Stat(filepath.Join(s.Prefix, path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", path)
+	}
+	return &ItemInfo{
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime(),
+		ContentType: mime.TypeByExtension(filepath.Ext(path)),
+	}, nil
+}
+
+func (s *LocalStorage) PutFile(ctx context.Context, item *Item) error {
+	defer item.Close()
+	dirname, fname := filepath.Split(s.path(item))
+
+	err := os.MkdirAll(dirname, os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dirname, fname)
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, contextReader{ctx, item})
+	if err != nil {
+		// Don't leave a partial file behind.
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if s.PreservePerms {
+		return applyPerms(path, item)
+	}
+	return nil
+}
+
+// applyPerms sets the mode and, if possible, the owner and group
+// stored in item's metadata on the file at path.
+func applyPerms(path string, item *Item) error {
+	if item.Mode != 0 {
+		err := os.Chmod(path, item.Mode)
+		if err != nil {
+			return err
+		}
+	}
+	uid, err := strconv.Atoi(item.Metadata["uid"])
+	if err != nil {
+		uid = -1
+	}
+	gid, err := strconv.Atoi(item.Metadata["gid"])
+	if err != nil {
+		gid = -1
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	// Only root may give away files, so this failing is not fatal.
+	if err := os.Chown(path, uid, gid); err != nil {
+		log.Printf("Could not change owner of %s: %s", path, err)
+	}
+	return nil
+}
+
+// TransferStats counts what happened to the items passed to CopyItems.
+type TransferStats struct {
+	Transferred, Skipped, Failed, Cancelled int64
+}
+
+func (st TransferStats) String() string {
+	return fmt.Sprintf("%d transferred, %d skipped, %d failed, %d not started", st.Transferred, st.Skipped, st.Failed, st.Cancelled)
+}
+
+// CopyOptions configures CopyItems.
+type CopyOptions struct {
+	// Concurrency is the number of items transferred at once.
+	Concurrency int
+	// Once MaxErrors transfers have failed, all others are aborted.
+	// If MaxErrors is 0, there is no limit.
+	MaxErrors int64
+	Policy    OverwritePolicy
+	// Progress tracks the state of the transfers and needs a slot
+	// for each worker. One is created if it is nil.
+	Progress *Progress
+	// Manifest, if set, records the transferred items.
+	Manifest *Manifest
+	// PipeCommand or UnpipeCommand, if set, transform the content
+	// of items on the way to dst (see pipeItem and unpipeItem).
+	PipeCommand, UnpipeCommand string
+	// Observer, if set, is notified of every transfer.
+	Observer TransferObserver
+
+	// The callbacks, if set, are called by the workers for each item,
+	// so they must be safe for concurrent use and should return
+	// quickly. OnStart is called when a worker picks up the item,
+	// before it is compared with the destination, and is followed
+	// by either OnComplete or OnError.
+	OnStart func(item *Item)
+	// OnProgress is called after every read from the content of
+	// the item with the number of bytes read so far.
+	OnProgress func(item *Item, read int64)
+	// OnComplete is called once the item has been transferred or
+	// skipped, which took d.
+	OnComplete func(item *Item, skipped bool, d time.Duration)
+	// OnError is called when the transfer of the item has failed.
+	OnError func(item *Item, err error)
+}
+
+// TransferObserver is notified of the transfers CopyItems makes,
+// e.g. to log or trace them.
+type TransferObserver interface {
+	// Begin is called when a worker picks up item, before it is
+	// compared with the destination. Both use the returned context.
+	Begin(ctx context.Context, item *Item) context.Context
+	// Copy is called when item is copied, i.e. it hasn't been skipped.
+	Copy(ctx context.Context, item *Item)
+	// End is called once item has been copied or skipped or has
+	// failed, which took d.
+	End(ctx context.Context, item *Item, skipped bool, err error, d time.Duration)
+}
+
+// CopyItems transfers items to dst until items is closed or stop is
+// cancelled. Transfers running when stop is cancelled are finished
+// unless ctx is cancelled, too, which aborts them.
+func CopyItems(ctx, stop context.Context, dst Storage, items <-chan *Item, opts CopyOptions) TransferStats {
+	progress := opts.Progress
+	if progress == nil {
+		progress = NewProgress(opts.Concurrency)
+	}
+	ctx, abort := context.WithCancel(ctx)
+	defer abort()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop.Done():
+			// Workers waiting while paused have to drain the items.
+			progress.Resume()
+		case <-done:
+		}
+	}()
+	if progress.LargeFileSize > 0 {
+		go progress.logLargeFiles(10*time.Second, done)
+	}
+	wg := &sync.WaitGroup{}
+	wg.Add(opts.Concurrency)
+	verbosef("Starting %d goroutines...", opts.Concurrency)
+	for i := 0; i < opts.Concurrency; i++ {
+		go func(worker int) {
+			defer wg.Done()
+			for item := range items {
+				progress.wait()
+				if stop.Err() != nil {
+					// Drain items so the listing isn't blocked.
+					item.Close()
+					progress.cancel()
+					continue
+				}
+				if ctx.Err() != nil {
+					// Aborted after too many errors.
+					item.Close()
+					return
+				}
+				var checksum *checksumReader
+				if opts.Manifest != nil {
+					checksum = checksumItem(item)
+				}
+				progress.begin(worker, item)
+				if opts.OnProgress != nil {
+					reportReads(item, opts.OnProgress)
+				}
+				if opts.OnStart != nil {
+					opts.OnStart(item)
+				}
+				start := time.Now()
+				tctx := ctx
+				if opts.Observer != nil {
+					tctx = opts.Observer.Begin(ctx, item)
+				}
+				skipped, err := transfer(tctx, dst, item, opts)
+				d := time.Since(start)
+				progress.end(worker, skipped, err)
+				if opts.Observer != nil {
+					opts.Observer.End(tctx, item, skipped, err, d)
+				}
+				switch {
+				case err != nil && opts.OnError != nil:
+					opts.OnError(item, err)
+				case err == nil && opts.OnComplete != nil:
+					opts.OnComplete(item, skipped, d)
+				}
+				if opts.Manifest != nil && err == nil && !skipped {
+					err := opts.Manifest.Add(ManifestEntry{Key: item.Key(), Size: item.Size, MD5: checksum.Sum(), Time: time.Now().UTC()})
+					if err != nil {
+						log.Printf("Could not add %s to manifest: %s", item, err)
+					}
+				}
+				if err != nil && opts.MaxErrors > 0 && progress.Stats().Failed >= opts.MaxErrors {
+					abort()
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return progress.Stats()
+}
+
+func transfer(ctx context.Context, dst Storage, item *Item, opts CopyOptions) (skipped bool, err error) {
+	skip, err := shouldSkip(ctx, dst, item, opts.Policy)
+	if err != nil || skip {
+		item.Close()
+		return skip, err
+	}
+	if opts.Observer != nil {
+		opts.Observer.Copy(ctx, item)
+	}
+	// Items are only opened now, so that skipped
+	// items aren't downloaded.
+	if err := item.open(ctx); err != nil {
+		return false, err
+	}
+	switch {
+	case opts.PipeCommand != "":
+		item, err = pipeItem(item, opts.PipeCommand)
+	case opts.UnpipeCommand != "":
+		item, err = unpipeItem(item, opts.UnpipeCommand)
+	}
+	if err != nil {
+		return false, err
+	}
+	return false, dst.PutFile(ctx, item)
+}
+
+func s3RegionByEndpoint(ep string) (aws.Region, error) {
+	for _, region := range aws.Regions {
+		if region.S3Endpoint == ep {
+			return region, nil
+		}
+	}
+	if m := s3EndpointRegion.FindStringSubmatch(ep); m != nil {
+		return S3RegionByName(m[1]), nil
+	}
+	return aws.Region{}, fmt.Errorf("Unknown region endpoint %s", ep)
+}
+
+func gcsRegionByEndpoint(ep string) (aws.Region, error) {
+	if ep != "https://storage.googleapis.com" {
+		return aws.Region{}, fmt.Errorf("Unknown region endpoint %s", ep)
+	}
+	return aws.Region{
+		Name:       "Google Cloud Storage",
+		S3Endpoint: ep,
+	}, nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	older = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newer = older.Add(time.Hour)
+)
+
+// copyFiles copies all files of src to dst and returns the paths of
+// the transferred ones.
+func copyFiles(t *testing.T, src, dst *MemoryStorage, opts CopyOptions) ([]string, TransferStats) {
+	t.Helper()
+	var mu sync.Mutex
+	var transferred []string
+	opts.OnComplete = func(item *Item, skipped bool, d time.Duration) {
+		if !skipped {
+			mu.Lock()
+			transferred = append(transferred, item.Key())
+			mu.Unlock()
+		}
+	}
+	if opts.Concurrency == 0 {
+		opts.Concurrency = 2
+	}
+	items, errs := src.ListFiles(context.Background())
+	stats := CopyItems(context.Background(), context.Background(), dst, items, opts)
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(transferred)
+	return transferred, stats
+}
+
+func TestCopyItemsPolicies(t *testing.T) {
+	tests := []struct {
+		policy OverwritePolicy
+		want   []string
+	}{
+		{OverwriteAlways, []string{"changed.txt", "grown.txt", "new.txt", "same.txt"}},
+		{OverwriteNever, []string{"new.txt"}},
+		{OverwriteChanged, []string{"changed.txt", "grown.txt", "new.txt"}},
+		{OverwriteOlder, []string{"changed.txt", "new.txt"}},
+		{OverwriteChangedSize, []string{"grown.txt", "new.txt"}},
+	}
+	for _, test := range tests {
+		src, dst := &MemoryStorage{}, &MemoryStorage{}
+		src.Put("same.txt", []byte("hello"), older)
+		dst.Put("same.txt", []byte("hello"), older)
+		src.Put("changed.txt", []byte("world"), newer)
+		dst.Put("changed.txt", []byte("w0rld"), older)
+		src.Put("grown.txt", []byte("longer"), older)
+		dst.Put("grown.txt", []byte("short"), newer)
+		src.Put("new.txt", []byte("new"), older)
+
+		got, stats := copyFiles(t, src, dst, CopyOptions{Policy: test.policy})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Policy %d transferred %v, want %v", test.policy, got, test.want)
+		}
+		want := TransferStats{Transferred: int64(len(test.want)), Skipped: int64(4 - len(test.want))}
+		if stats != want {
+			t.Errorf("Policy %d: %s, want %s", test.policy, stats, want)
+		}
+		for _, p := range test.want {
+			srcData, _ := src.Get(p)
+			if dstData, _ := dst.Get(p); string(dstData) != string(srcData) {
+				t.Errorf("Policy %d: %s is %q, want %q", test.policy, p, dstData, srcData)
+			}
+		}
+	}
+}
+
+func TestCopyItemsFilters(t *testing.T) {
+	src := &MemoryStorage{}
+	src.Put("index.html", []byte("<html>"), newer)
+	src.Put("app.js", []byte("console.log()"), newer)
+	src.Put("app.js.map", []byte("{}"), newer)
+	src.Put("img/logo.png", make([]byte, 2048), older)
+	src.Put("node_modules/x/index.js", []byte("x"), newer)
+
+	tests := []struct {
+		name string
+		keep func(item *Item) bool
+		want []string
+	}{
+		{
+			name: "exclude",
+			keep: MatchPath(Filter{{Pattern: "*.map"}, {Pattern: "node_modules/"}}),
+			want: []string{"app.js", "img/logo.png", "index.html"},
+		},
+		{
+			name: "include before exclude",
+			keep: MatchPath(Filter{{Include: true, Pattern: "*.html"}, {Pattern: "*"}}),
+			want: []string{"index.html"},
+		},
+		{
+			name: "regex",
+			keep: MatchPath(&RegexFilter{Include: mustCompile(t, `\.js$`)}),
+			want: []string{"app.js", "node_modules/x/index.js"},
+		},
+		{
+			name: "size",
+			keep: SizeRange{Min: 1024}.MatchItem,
+			want: []string{"img/logo.png"},
+		},
+		{
+			name: "time",
+			keep: TimeRange{Before: newer}.MatchItem,
+			want: []string{"img/logo.png"},
+		},
+	}
+	for _, test := range tests {
+		dst := &MemoryStorage{}
+		items, errs := src.ListFiles(context.Background())
+		CopyItems(context.Background(), context.Background(), dst, FilterItems(items, test.keep), CopyOptions{Concurrency: 2})
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		if got := dst.Paths(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: copied %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCopyItemsMaxErrors(t *testing.T) {
+	src := &MemoryStorage{}
+	for _, p := range []string{"a", "b", "c", "d"} {
+		src.Put(p, []byte(p), older)
+	}
+	items, _ := src.ListFiles(context.Background())
+	// Items whose size doesn't match their content fail.
+	broken := make(chan *Item)
+	go func() {
+		defer close(broken)
+		for item := range items {
+			item.Size++
+			broken <- item
+		}
+	}()
+	stats := CopyItems(context.Background(), context.Background(), &MemoryStorage{}, broken, CopyOptions{Concurrency: 1, MaxErrors: 2})
+	for range broken {
+	}
+	if stats.Failed != 2 || stats.Transferred != 0 {
+		t.Errorf("Got %s, want 2 failed", stats)
+	}
+}
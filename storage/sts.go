@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/amz.v1/aws"
+)
+
+const stsEndpoint = "https://sts.amazonaws.com"
+
+// AssumeRoleCredentials returns the credentials of the role roleArn,
+// which is assumed with the keys provided by source. externalId is
+// only needed if the role's trust policy asks for it. If sessionName
+// is empty, one is generated. STS is called with client.
+func AssumeRoleCredentials(client *http.Client, source *AWSCredentials, roleArn, externalId, sessionName string) *AWSCredentials {
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("s3put-%d", time.Now().Unix())
+	}
+	return &AWSCredentials{fetch: func() (AWSKeys, time.Time, error) {
+		keys, err := source.Get()
+		if err != nil {
+			return AWSKeys{}, time.Time{}, err
+		}
+		params := url.Values{
+			"Action":          {"AssumeRole"},
+			"RoleArn":         {roleArn},
+			"RoleSessionName": {sessionName},
+		}
+		if externalId != "" {
+			params.Set("ExternalId", externalId)
+		}
+		return stsRequest(client, params, &keys)
+	}}
+}
+
+// WebIdentityCredentials returns the credentials of the role roleArn,
+// which is assumed with the OIDC token in tokenFile, as issued to CI
+// jobs by GitHub Actions or GitLab CI. The file is read again whenever
+// the credentials are refreshed, as these tokens are short-lived, too.
+// STS is called with client.
+func WebIdentityCredentials(client *http.Client, tokenFile, roleArn, sessionName string) *AWSCredentials {
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("s3put-%d", time.Now().Unix())
+	}
+	return &AWSCredentials{fetch: func() (AWSKeys, time.Time, error) {
+		token, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return AWSKeys{}, time.Time{}, err
+		}
+		return stsRequest(client, url.Values{
+			"Action":           {"AssumeRoleWithWebIdentity"},
+			"RoleArn":          {roleArn},
+			"RoleSessionName":  {sessionName},
+			"WebIdentityToken": {strings.TrimSpace(string(token))},
+		}, nil)
+	}}
+}
+
+// stsRequest calls the STS action in params, signed with keys if they
+// are given, and returns the temporary keys in the response.
+func stsRequest(client *http.Client, params url.Values, keys *AWSKeys) (AWSKeys, time.Time, error) {
+	params.Set("Version", "2011-06-15")
+	params.Set("DurationSeconds", "3600")
+	u := stsEndpoint + "/?" + encodeParams(params)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+	if keys != nil {
+		if keys.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", keys.SessionToken)
+		}
+		req.Header.Set("X-Amz-Content-Sha256", hexSHA256(""))
+		signV4(req, params, aws.Auth{AccessKey: keys.AccessKey, SecretKey: keys.SecretKey}, "us-east-1", "sts", time.Now())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var result struct {
+			Code    string `xml:"Error>Code"`
+			Message string `xml:"Error>Message"`
+		}
+		if xml.NewDecoder(resp.Body).Decode(&result) != nil || result.Code == "" {
+			return AWSKeys{}, time.Time{}, fmt.Errorf("%s failed: %s", params.Get("Action"), resp.Status)
+		}
+		return AWSKeys{}, time.Time{}, fmt.Errorf("%s: %s", result.Code, result.Message)
+	}
+	// The result element is named after the action.
+	var result struct {
+		Results []struct {
+			Credentials *struct {
+				AccessKeyId     string
+				SecretAccessKey string
+				SessionToken    string
+				Expiration      time.Time
+			}
+		} `xml:",any"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return AWSKeys{}, time.Time{}, err
+	}
+	for _, r := range result.Results {
+		if c := r.Credentials; c != nil {
+			return AWSKeys{
+				AccessKey:    c.AccessKeyId,
+				SecretKey:    c.SecretAccessKey,
+				SessionToken: c.SessionToken,
+			}, c.Expiration, nil
+		}
+	}
+	return AWSKeys{}, time.Time{}, fmt.Errorf("No credentials in %s response", params.Get("Action"))
+}
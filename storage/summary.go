@@ -0,0 +1,37 @@
+package storage
+
+import "time"
+
+// Summary is the result of the transfers tracked by a Progress.
+type Summary struct {
+	Transferred int64     `json:"transferred"`
+	Skipped     int64     `json:"skipped"`
+	Failed      int64     `json:"failed"`
+	NotStarted  int64     `json:"not_started"`
+	Bytes       int64     `json:"bytes"`
+	Duration    float64   `json:"duration"`
+	Interrupted bool      `json:"interrupted"`
+	Failures    []Failure `json:"failures"`
+}
+
+// Failure is an item that could not be transferred.
+type Failure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// Summary returns the final statistics of the transfers.
+func (p *Progress) Summary() Summary {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failures := append([]Failure{}, p.failures...)
+	return Summary{
+		Transferred: p.stats.Transferred,
+		Skipped:     p.stats.Skipped,
+		Failed:      p.stats.Failed,
+		NotStarted:  p.stats.Cancelled,
+		Bytes:       p.done,
+		Duration:    time.Since(p.start).Seconds(),
+		Failures:    failures,
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// TagCondition requires an object to have the tag Key. If Value is
+// not empty, the tag must have that value or, if Negate is set,
+// the object must not have the tag with that value.
+type TagCondition struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+// TagFilter matches objects whose tags satisfy all conditions.
+type TagFilter []TagCondition
+
+// ParseTagFilter parses conditions of the form `key=value`,
+// `key!=value` or just `key`.
+func ParseTagFilter(ss []string) (TagFilter, error) {
+	var f TagFilter
+	for _, s := range ss {
+		var c TagCondition
+		switch {
+		case strings.Contains(s, "!="):
+			parts := strings.SplitN(s, "!=", 2)
+			c = TagCondition{Key: parts[0], Value: parts[1], Negate: true}
+		case strings.Contains(s, "="):
+			parts := strings.SplitN(s, "=", 2)
+			c = TagCondition{Key: parts[0], Value: parts[1]}
+		default:
+			c = TagCondition{Key: s}
+		}
+		if c.Key == "" {
+			return nil, fmt.Errorf("Invalid tag condition %q", s)
+		}
+		f = append(f, c)
+	}
+	return f, nil
+}
+
+func (f TagFilter) Match(tags map[string]string) bool {
+	for _, c := range f {
+		value, ok := tags[c.Key]
+		switch {
+		case c.Negate:
+			if ok && value == c.Value {
+				return false
+			}
+		case !ok:
+			return false
+		case c.Value != "" && value != c.Value:
+			return false
+		}
+	}
+	return true
+}
+
+// tags fetches the tags of the object at key. If versionId is empty,
+// the tags of the latest version are returned.
+func (s *S3Storage) tags(ctx context.Context, key, versionId string) (map[string]string, error) {
+	params := url.Values{"tagging": {""}}
+	if versionId != "" {
+		params.Set("versionId", versionId)
+	}
+	resp, err := s.request(ctx, "GET", key, params, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tagging struct {
+		Tags []struct {
+			Key   string
+			Value string
+		} `xml:"TagSet>Tag"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&tagging)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, tag := range tagging.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
+
+// matchesTags reports whether the object at key matches s.TagFilter.
+func (s *S3Storage) matchesTags(ctx context.Context, key, versionId string) (bool, error) {
+	if len(s.TagFilter) == 0 {
+		return true, nil
+	}
+	tags, err := s.tags(ctx, key, versionId)
+	if err != nil {
+		return false, err
+	}
+	return s.TagFilter.Match(tags), nil
+}
@@ -0,0 +1,72 @@
+package storage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var sizeSuffixes = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// ParseSize parses a byte size with an optional binary unit suffix
+// like `512`, `10K`, `5M` or `2G`.
+func ParseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if s == "" {
+		return 0, fmt.Errorf("Empty size")
+	}
+	mult := int64(1)
+	if m, ok := sizeSuffixes[s[len(s)-1]]; ok {
+		mult = m
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// FormatSize formats a byte size with a binary unit like `1.5 MiB`.
+func FormatSize(n int64) string {
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		f /= 1 << 10
+		if f < 1<<10 {
+			return fmt.Sprintf("%.1f %s", f, unit)
+		}
+	}
+	return fmt.Sprintf("%.1f TiB", f/(1<<10))
+}
+
+// ParseTime parses either a point in time (RFC 3339 or a plain date
+// like `2016-01-02`) or a duration like `24h` that is subtracted from now.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	return parseTimeOrDuration(s, now, -1)
+}
+
+// ParseFutureTime is like ParseTime, but adds durations to now.
+func ParseFutureTime(s string, now time.Time) (time.Time, error) {
+	return parseTimeOrDuration(s, now, 1)
+}
+
+func parseTimeOrDuration(s string, now time.Time, sign time.Duration) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(sign * d), nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid time or duration %q", s)
+}
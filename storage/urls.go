@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// URLStorage provides the files at a list of HTTP(S) URLs, so that
+// they can be streamed into a bucket. Each file is stored at the path
+// of its URL, `index.html` is appended to paths ending in a slash.
+type URLStorage struct {
+	URLs []string
+	// Client fetches the URLs. If it is nil, a client
+	// of its own is used.
+	Client *http.Client
+}
+
+// ReadURLList reads a list of URLs from the file at path (or stdin
+// if path is `-`), one URL per line. Empty lines and lines starting
+// with `#` are ignored.
+func ReadURLList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	scanner := bufio.NewScanner(r)
+	var urls []string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("Invalid URL %s, must be http or https", line)
+		}
+		urls = append(urls, line)
+	}
+	return urls, scanner.Err()
+}
+
+func (s *URLStorage) ListFiles(ctx context.Context) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		client := s.Client
+		if client == nil {
+			client = NewHTTPClient()
+		}
+		skipped := 0
+		for _, u := range s.URLs {
+			item, err := statURL(ctx, client, u)
+			if err != nil {
+				log.Printf("Could not fetch %s: %s", u, err)
+				skipped++
+				continue
+			}
+			if !sendItem(ctx, c, item) {
+				return nil
+			}
+		}
+		return skippedFiles(skipped)
+	})
+}
+
+func (s *URLStorage) PutFile(ctx context.Context, item *Item) error {
+	return errors.New("Cannot upload to URLs")
+}
+
+func (s *URLStorage) Stat(ctx context.Context, path string) (*ItemInfo, error) {
+	return nil, errors.New("Cannot look up files by path in URLs")
+}
+
+// statURL looks up the file at rawurl with a HEAD request. Its content
+// is only requested once the item is opened. Servers that don't answer
+// HEAD requests leave the size unknown until then.
+func statURL(ctx context.Context, client *http.Client, rawurl string) (*Item, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	p := strings.TrimPrefix(path.Clean("/"+u.Path), "/")
+	if p == "" || strings.HasSuffix(u.Path, "/") {
+		p = path.Join(p, "index.html")
+	}
+	item := &Item{
+		Path:    p,
+		Size:    -1,
+		ModTime: time.Now(),
+		Open: func(ctx context.Context, item *Item) error {
+			return openURL(ctx, client, rawurl, item)
+		},
+	}
+	resp, err := requestURL(ctx, client, "HEAD", rawurl)
+	if err != nil {
+		if resp != nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+			return item, nil
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	item.Size = resp.ContentLength
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		item.ModTime = modTime
+	}
+	return item, nil
+}
+
+// openURL requests the content of item from rawurl. Uploads need to
+// know their size in advance, so servers have to send a Content-Length.
+func openURL(ctx context.Context, client *http.Client, rawurl string, item *Item) error {
+	resp, err := requestURL(ctx, client, "GET", rawurl)
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return errors.New("Server did not send the size of the file")
+	}
+	item.Size = resp.ContentLength
+	item.ReadCloser = resp.Body
+	return nil
+}
+
+// requestURL sends a request for rawurl. Responses other than 200 OK
+// are returned with an error and a closed body.
+func requestURL(ctx context.Context, client *http.Client, method, rawurl string) (*http.Response, error) {
+	req, err := http.NewRequest(method, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	// Keep net/http from decompressing transparently, which
+	// hides the length of the content.
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return resp, errors.New(resp.Status)
+	}
+	return resp, nil
+}
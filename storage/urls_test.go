@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestURLStorageOpensLazily(t *testing.T) {
+	var gets int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nohead.txt" && r.Method == "HEAD" {
+			http.Error(w, "no HEAD", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == "GET" {
+			atomic.AddInt32(&gets, 1)
+		}
+		w.Header().Set("Last-Modified", "Wed, 01 Mar 2017 12:00:00 GMT")
+		w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer srv.Close()
+
+	s := &URLStorage{URLs: []string{srv.URL + "/a/b.txt", srv.URL + "/nohead.txt", srv.URL + "/"}}
+	items, errs := s.ListFiles(context.Background())
+	var listed []*Item
+	for item := range items {
+		listed = append(listed, item)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&gets); n != 0 {
+		t.Errorf("Listing sent %d GET requests", n)
+	}
+	want := []struct {
+		path       string
+		listedSize int64
+		content    string
+	}{
+		{"a/b.txt", 19, "content of /a/b.txt"},
+		{"nohead.txt", -1, "content of /nohead.txt"},
+		{"index.html", 12, "content of /"},
+	}
+	if len(listed) != len(want) {
+		t.Fatalf("Listed %d items, want %d", len(listed), len(want))
+	}
+	for i, item := range listed {
+		if item.Path != want[i].path || item.Size != want[i].listedSize {
+			t.Errorf("Listed %s with size %d, want %s with size %d", item.Path, item.Size, want[i].path, want[i].listedSize)
+		}
+		if err := item.open(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(item)
+		item.Close()
+		if err != nil || string(data) != want[i].content || item.Size != int64(len(data)) {
+			t.Errorf("%s: got %q (size %d), %v", item.Path, data, item.Size, err)
+		}
+	}
+}
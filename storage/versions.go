@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/amz.v1/s3"
+)
+
+// ObjectVersion is a version of an object in a versioned bucket.
+// Delete markers are versions without content.
+type ObjectVersion struct {
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	LastModified string
+	ETag         string
+	Size         int64
+	DeleteMarker bool
+}
+
+func (v ObjectVersion) s3Key() s3.Key {
+	return s3.Key{
+		Key:          v.Key,
+		LastModified: v.LastModified,
+		Size:         v.Size,
+		ETag:         v.ETag,
+	}
+}
+
+func (v ObjectVersion) modTime() time.Time {
+	t, _ := time.Parse(time.RFC3339, v.LastModified)
+	return t
+}
+
+// ListVersions returns all versions of the objects below prefix,
+// grouped by key with the newest version first.
+func (s *S3Storage) ListVersions(ctx context.Context, prefix string) ([]ObjectVersion, error) {
+	var versions []ObjectVersion
+	params := url.Values{"versions": {""}, "prefix": {prefix}}
+	for {
+		resp, err := s.request(ctx, "GET", "", params, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			IsTruncated         bool
+			NextKeyMarker       string
+			NextVersionIdMarker string
+			// Versions and delete markers are interleaved,
+			// so they are collected in a single list.
+			Entries []struct {
+				XMLName xml.Name
+				ObjectVersion
+			} `xml:",any"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range result.Entries {
+			switch entry.XMLName.Local {
+			case "Version":
+			case "DeleteMarker":
+				entry.DeleteMarker = true
+			default:
+				continue
+			}
+			entry.ETag = normalizeETag(entry.ETag)
+			versions = append(versions, entry.ObjectVersion)
+		}
+		if !result.IsTruncated {
+			return versions, nil
+		}
+		params.Set("key-marker", result.NextKeyMarker)
+		params.Set("version-id-marker", result.NextVersionIdMarker)
+	}
+}
+
+// selectVersions picks the version of each object that get should
+// fetch: the version with the given id or the newest version created
+// before asOf (or the latest version if asOf is zero). Objects whose
+// selected version is a delete marker are left out.
+func selectVersions(versions []ObjectVersion, versionId string, asOf time.Time) []ObjectVersion {
+	var selected []ObjectVersion
+	for i := 0; i < len(versions); {
+		key := versions[i].Key
+		var found *ObjectVersion
+		for ; i < len(versions) && versions[i].Key == key; i++ {
+			v := versions[i]
+			if found != nil {
+				continue
+			}
+			switch {
+			case versionId != "":
+				if v.VersionId != versionId {
+					continue
+				}
+			case !asOf.IsZero():
+				if v.modTime().After(asOf) {
+					continue
+				}
+			default:
+				if !v.IsLatest {
+					continue
+				}
+			}
+			found = &v
+		}
+		if found != nil && !found.DeleteMarker {
+			selected = append(selected, *found)
+		}
+	}
+	return selected
+}
+
+// listVersions is ListFiles for an older state of the bucket.
+func (s *S3Storage) listVersions(ctx context.Context, prefixes []string, c chan<- *Item) error {
+	skipped := 0
+	for _, prefix := range prefixes {
+		versions, err := s.ListVersions(ctx, prefix)
+		if err != nil {
+			if prefix == s.prefix {
+				return fmt.Errorf("Could not list versions of %s: %s", prefix, err)
+			}
+			log.Printf("Could not list versions of %s: %s", prefix, err)
+			skipped++
+			continue
+		}
+		for _, v := range selectVersions(versions, s.VersionId, s.AsOf) {
+			// Listing a single path also lists objects it is a prefix of.
+			if prefix != s.prefix && v.Key != prefix {
+				continue
+			}
+			if ok, err := s.matchesTags(ctx, v.Key, v.VersionId); err != nil || !ok {
+				if err != nil {
+					log.Printf("Could not get tags of %s: %s", v.Key, err)
+					skipped++
+				}
+				continue
+			}
+			if !sendItem(ctx, c, s.lazyItem(v.s3Key(), v.VersionId)) {
+				return nil
+			}
+		}
+	}
+	return skippedFiles(skipped)
+}
+
+// PrintVersions writes a table of all versions of the objects
+// below the storage's prefix to w.
+func PrintVersions(ctx context.Context, w io.Writer, s *S3Storage) error {
+	versions, err := s.ListVersions(ctx, s.prefix)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, v := range versions {
+		var flags []string
+		if v.IsLatest {
+			flags = append(flags, "latest")
+		}
+		if v.DeleteMarker {
+			flags = append(flags, "deleted")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", v.LastModified, v.VersionId, v.Key, v.Size, strings.Join(flags, ","))
+	}
+	return tw.Flush()
+}
+
+// Undelete removes the delete markers that hide the newest version
+// of the objects below the storage's prefix and prints the keys of
+// restored objects to w. Objects without any version but delete
+// markers cannot be restored and are left alone.
+func Undelete(ctx context.Context, w io.Writer, s *S3Storage) error {
+	versions, err := s.ListVersions(ctx, s.prefix)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for i := 0; i < len(versions); {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		key := versions[i].Key
+		var markers []ObjectVersion
+		restorable := false
+		for ; i < len(versions) && versions[i].Key == key; i++ {
+			if restorable {
+				continue
+			}
+			if !versions[i].DeleteMarker {
+				restorable = true
+				continue
+			}
+			markers = append(markers, versions[i])
+		}
+		if !restorable || len(markers) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ok := true
+		for _, marker := range markers {
+			resp, err := s.request(ctx, "DELETE", key, url.Values{"versionId": {marker.VersionId}}, nil, nil, 0)
+			if err != nil {
+				log.Printf("Could not remove delete marker %s of %s: %s", marker.VersionId, key, err)
+				ok = false
+				break
+			}
+			resp.Body.Close()
+		}
+		if !ok {
+			failed = append(failed, key)
+			continue
+		}
+		fmt.Fprintf(w, "undeleted: %s\n", key)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Could not undelete %d objects", len(failed))
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// WatchFiles lists the files below the storage's prefix that are
+// created or modified from now on until ctx is cancelled. Files are
+// listed once they haven't changed for delay, so that files which are
+// still being written aren't uploaded half-way and a burst of writes
+// results in a single upload. Deleted files are not propagated.
+func (s *LocalStorage) WatchFiles(ctx context.Context, delay time.Duration) (<-chan *Item, error) {
+	root, err := filepath.Abs(s.Prefix)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, errors.New("Only directories can be watched")
+	}
+	ignore, err := ReadIgnoreFile(filepath.Join(root, IgnoreFileName))
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &watch{
+		LocalStorage: s,
+		root:         root,
+		ignore:       ignore,
+		watcher:      watcher,
+		pending:      map[string]time.Time{},
+	}
+	// Subdirectories created later are added as they appear.
+	w.addDir(root, false)
+	c := make(chan *Item)
+	go w.run(ctx, delay, c)
+	return c, nil
+}
+
+type watch struct {
+	*LocalStorage
+	root    string
+	ignore  Filter
+	watcher *fsnotify.Watcher
+	// pending holds the paths of changed files
+	// with the time of their last change.
+	pending map[string]time.Time
+}
+
+func (w *watch) run(ctx context.Context, delay time.Duration, c chan<- *Item) {
+	defer close(c)
+	defer w.watcher.Close()
+	ticker := time.NewTicker(delay / 4)
+	defer ticker.Stop()
+	var ready []string
+	var item *Item
+	for {
+		if item == nil && len(ready) > 0 {
+			item = w.open(ready[0])
+			ready = ready[1:]
+			if item == nil {
+				continue
+			}
+		}
+		// Only send if there is an item,
+		// sending on a nil channel blocks.
+		var send chan<- *Item
+		if item != nil {
+			send = c
+		}
+		select {
+		case send <- item:
+			item = nil
+		case ev := <-w.watcher.Events:
+			w.handle(ev)
+		case err := <-w.watcher.Errors:
+			log.Printf("Error watching %s: %s", w.root, err)
+		case now := <-ticker.C:
+			var quiet []string
+			for path, changed := range w.pending {
+				if now.Sub(changed) >= delay {
+					quiet = append(quiet, path)
+					delete(w.pending, path)
+				}
+			}
+			sort.Strings(quiet)
+			ready = append(ready, quiet...)
+		case <-ctx.Done():
+			if item != nil {
+				item.Close()
+			}
+			return
+		}
+	}
+}
+
+func (w *watch) handle(ev fsnotify.Event) {
+	switch {
+	case ev.Op&(fsnotify.Create|fsnotify.Write) != 0:
+		lfi, err := os.Lstat(ev.Name)
+		if err != nil {
+			// Temporary files are often gone again
+			// before they could be looked at.
+			return
+		}
+		link := lfi.Mode()&os.ModeSymlink != 0
+		if link && w.Symlinks == SymlinkSkip {
+			return
+		}
+		fi, err := os.Stat(ev.Name)
+		if err != nil {
+			return
+		}
+		if fi.IsDir() {
+			if link && w.Symlinks != SymlinkFollow {
+				return
+			}
+			if ev.Op&fsnotify.Create != 0 && w.watchable(ev.Name, true) {
+				w.addDir(ev.Name, true)
+			}
+			return
+		}
+		if w.watchable(ev.Name, false) {
+			w.pending[ev.Name] = time.Now()
+		}
+	case ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		delete(w.pending, ev.Name)
+	}
+}
+
+// watchable reports whether the file or directory at path would be
+// listed by ListFiles.
+func (w *watch) watchable(path string, dir bool) bool {
+	relpath := filepath.ToSlash(relativePath(path, w.root))
+	if w.ExcludeHidden && strings.HasPrefix(filepath.Base(path), ".") {
+		return false
+	}
+	if !dir {
+		return w.ignore.Match(relpath)
+	}
+	depth := strings.Count(relpath, "/") + 1
+	return w.ignore.MatchDir(relpath) && (w.MaxDepth == 0 || depth < w.MaxDepth)
+}
+
+// addDir watches dir and the directories below it. If created is true,
+// the files already in them are listed, as they may have been created
+// before the watches were added.
+func (w *watch) addDir(dir string, created bool) {
+	if err := w.watcher.Add(dir); err != nil {
+		log.Printf("Could not watch %s: %s", dir, err)
+		return
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Printf("Could not read directory %s: %s", dir, err)
+		return
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		switch {
+		case info.IsDir():
+			if w.watchable(path, true) {
+				w.addDir(path, created)
+			}
+		case created && info.Mode().IsRegular() && w.watchable(path, false):
+			w.pending[path] = time.Now()
+		}
+	}
+}
+
+// open opens the file at path, returning nil if that is not possible.
+func (w *watch) open(path string) *Item {
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not open %s: %s", path, err)
+		}
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		f.Close()
+		return nil
+	}
+	return &Item{
+		Prefix:     w.root,
+		Path:       path,
+		Size:       fi.Size(),
+		ModTime:    fi.ModTime(),
+		Mode:       fi.Mode(),
+		Metadata:   ownerMetadata(fi),
+		ReadCloser: f,
+	}
+}
@@ -0,0 +1,301 @@
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebDAVStorage stores files on a WebDAV server like Nextcloud
+// or ownCloud.
+type WebDAVStorage struct {
+	// endpoint is the scheme and host of the server.
+	endpoint string
+	user     string
+	password string
+	// base is the directory files are stored in.
+	base string
+	// Client sends the requests to the server.
+	Client *http.Client
+
+	// made holds the collections created by mkcolAll.
+	madeMu sync.Mutex
+	made   map[string]bool
+}
+
+// NewWebDAVStorage creates a storage for a URL like `webdav://host/dir`
+// (using HTTPS) or `webdav+http://host/dir`.
+func NewWebDAVStorage(storageUrl, user, password, prefix string) (*WebDAVStorage, error) {
+	u, err := url.Parse(storageUrl)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "https"
+	switch u.Scheme {
+	case "webdav":
+	case "webdav+http":
+		scheme = "http"
+	default:
+		return nil, fmt.Errorf("Invalid WebDAV URL %s", storageUrl)
+	}
+	base := path.Join("/", u.Path, prefix)
+	return &WebDAVStorage{
+		endpoint: scheme + "://" + u.Host,
+		user:     user,
+		password: password,
+		base:     base,
+		Client:   NewHTTPClient(),
+		// Collections above the storage's directory usually can't
+		// be created (or even listed) by the user, so they are
+		// assumed to exist.
+		made: map[string]bool{path.Dir(base): true},
+	}, nil
+}
+
+// request sends an authenticated request for the resource at p.
+// Responses with a status other than 2xx are turned into an error.
+func (s *WebDAVStorage) request(ctx context.Context, method, p string, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.endpoint+(&url.URL{Path: p}).EscapedPath(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = length
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	// Shares can be public, in which case there are no credentials.
+	anonymous := s.user == "" && s.password == ""
+	if !anonymous {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		status := resp.Status
+		if resp.StatusCode == http.StatusUnauthorized && anonymous {
+			status += " (the server requires a user name and password)"
+		}
+		return nil, &davError{Method: method, Path: p, StatusCode: resp.StatusCode, Status: status}
+	}
+	return resp, nil
+}
+
+// davError is the error for a response with a status other than 2xx.
+type davError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+}
+
+func (e *davError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+// davEntry is a resource in a PROPFIND response.
+type davEntry struct {
+	Path       string
+	Collection bool
+	Size       int64
+	ModTime    time.Time
+	ETag       string
+}
+
+// propfind lists the members of the collection dir.
+func (s *WebDAVStorage) propfind(ctx context.Context, dir string) ([]davEntry, error) {
+	body := `<?xml version="1.0"?><propfind xmlns="DAV:"><prop>` +
+		`<resourcetype/><getcontentlength/><getlastmodified/><getetag/>` +
+		`</prop></propfind>`
+	header := http.Header{
+		"Depth":        {"1"},
+		"Content-Type": {"application/xml"},
+	}
+	resp, err := s.request(ctx, "PROPFIND", strings.TrimSuffix(dir, "/")+"/", header, strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Responses []struct {
+			Href string `xml:"href"`
+			Prop struct {
+				Collection    *struct{} `xml:"resourcetype>collection"`
+				ContentLength int64     `xml:"getcontentlength"`
+				LastModified  string    `xml:"getlastmodified"`
+				ETag          string    `xml:"getetag"`
+			} `xml:"propstat>prop"`
+		} `xml:"response"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	var entries []davEntry
+	for _, r := range result.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		p := path.Clean(href.Path)
+		// The collection itself is part of the response.
+		if p == path.Clean(dir) {
+			continue
+		}
+		modTime, _ := time.Parse(http.TimeFormat, r.Prop.LastModified)
+		entries = append(entries, davEntry{
+			Path:       p,
+			Collection: r.Prop.Collection != nil,
+			Size:       r.Prop.ContentLength,
+			ModTime:    modTime,
+			ETag:       r.Prop.ETag,
+		})
+	}
+	return entries, nil
+}
+
+func (s *WebDAVStorage) ListFiles(ctx context.Context) (<-chan *Item, <-chan error) {
+	return listItems(func(c chan<- *Item) error {
+		dirs := []string{s.base}
+		for len(dirs) > 0 {
+			dir := dirs[0]
+			dirs = dirs[1:]
+			entries, err := s.propfind(ctx, dir)
+			if err != nil {
+				return fmt.Errorf("Could not list %s: %s", dir, err)
+			}
+			for _, entry := range entries {
+				if entry.Collection {
+					dirs = append(dirs, entry.Path)
+					continue
+				}
+				entry := entry
+				item := &Item{
+					Prefix:  s.base,
+					Path:    entry.Path,
+					Size:    entry.Size,
+					ModTime: entry.ModTime,
+					Open: func(ctx context.Context, item *Item) error {
+						item.ReadCloser = &davReader{ctx: ctx, storage: s, path: entry.Path}
+						return nil
+					},
+				}
+				if !sendItem(ctx, c, item) {
+					return nil
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// StatFiles is ListFiles, as its items are only opened when read.
+func (s *WebDAVStorage) StatFiles(ctx context.Context) <-chan *Item {
+	items, _ := s.ListFiles(ctx)
+	return items
+}
+
+// Stat looks up the file at path with a HEAD request.
+func (s *WebDAVStorage) Stat(ctx context.Context, p string) (*ItemInfo, error) {
+	target := path.Join(s.base, filepath.ToSlash(p))
+	resp, err := s.request(ctx, "HEAD", target, nil, nil, 0)
+	if daverr, ok := err.(*davError); ok && daverr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &ItemInfo{
+		Size:        resp.ContentLength,
+		ModTime:     modTime,
+		ETag:        resp.Header.Get("ETag"),
+		ContentType: resp.Header.Get("Content-Type"),
+	}, nil
+}
+
+func (s *WebDAVStorage) PutFile(ctx context.Context, item *Item) error {
+	defer item.Close()
+	target := path.Join(s.base, filepath.ToSlash(strings.TrimPrefix(item.Path, item.Prefix)))
+	err := s.mkcolAll(ctx, path.Dir(target))
+	if err != nil {
+		return err
+	}
+	// A zero length with a body would be sent chunked,
+	// which many servers don't accept.
+	var body io.Reader = item
+	if item.Size == 0 {
+		body = http.NoBody
+	}
+	resp, err := s.request(ctx, "PUT", target, nil, body, item.Size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkcolAll creates the collection dir and all its parents.
+func (s *WebDAVStorage) mkcolAll(ctx context.Context, dir string) error {
+	s.madeMu.Lock()
+	defer s.madeMu.Unlock()
+	var parents []string
+	for d := dir; d != "/" && d != "." && !s.made[d]; d = path.Dir(d) {
+		parents = append(parents, d)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		// Existing collections are reported with 405 (Method Not Allowed),
+		// so only check that the collection exists afterwards.
+		resp, err := s.request(ctx, "MKCOL", parents[i]+"/", nil, nil, 0)
+		if err == nil {
+			resp.Body.Close()
+		} else if _, err := s.propfind(ctx, parents[i]); err != nil {
+			return fmt.Errorf("Could not create %s: %s", parents[i], err)
+		}
+		s.made[parents[i]] = true
+	}
+	return nil
+}
+
+// davReader downloads a file once it is first read, so that
+// items waiting to be transferred don't hold a connection.
+type davReader struct {
+	ctx     context.Context
+	storage *WebDAVStorage
+	path    string
+	body    io.ReadCloser
+	err     error
+}
+
+func (r *davReader) Read(p []byte) (int, error) {
+	if r.body == nil && r.err == nil {
+		var resp *http.Response
+		resp, r.err = r.storage.request(r.ctx, "GET", r.path, nil, nil, 0)
+		if r.err == nil {
+			r.body = resp.Body
+		}
+	}
+	if r.err != nil {
+		return 0, r.err
+	}
+	return r.body.Read(p)
+}
+
+func (r *davReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// ProgressFileEnv is the environment variable with the file a job run
+// by the daemon writes its progress to, as a summary of the run so far.
+const ProgressFileEnv = "S3PUT_PROGRESS_FILE"
+
+// WriteSummary writes s as JSON to the file at path (or stdout if
+// path is `-`).
+func WriteSummary(path string, s storage.Summary) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// WriteProgress writes the summary of the transfers so far to the file
+// at path every interval until ctx is cancelled. The file is replaced
+// at once, so readers never see a partial summary.
+func WriteProgress(ctx context.Context, path string, p *storage.Progress, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		err := WriteSummary(path+".tmp", p.Summary())
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+		if err != nil {
+			log.Printf("Could not write progress: %s", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"log/syslog"
+)
+
+func openSyslog() (Syslogger, error) {
+	return syslog.New(syslog.LOG_NOTICE|syslog.LOG_USER, "s3put")
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"errors"
+)
+
+func openSyslog() (Syslogger, error) {
+	return nil, errors.New("There is no syslog on Windows")
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// setEcho turns echoing of the input typed into the terminal f on or off.
+func setEcho(f *os.File, on bool) error {
+	arg := "-echo"
+	if on {
+		arg = "echo"
+	}
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = f
+	return cmd.Run()
+}
+
+// terminalWidth returns the number of columns of the terminal f,
+// or 80 if it can't be found out.
+func terminalWidth(f *os.File) int {
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = f
+	out, err := cmd.Output()
+	if err != nil {
+		return 80
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return 80
+	}
+	width, err := strconv.Atoi(fields[1])
+	if err != nil || width <= 0 {
+		return 80
+	}
+	return width
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32                       = syscall.NewLazyDLL("kernel32.dll")
+	procSetConsoleMode             = kernel32.NewProc("SetConsoleMode")
+	procGetConsoleScreenBufferInfo = kernel32.NewProc("GetConsoleScreenBufferInfo")
+)
+
+const enableEchoInput = 0x4
+
+// setEcho turns echoing of the input typed into the console f on or off.
+func setEcho(f *os.File, on bool) error {
+	var mode uint32
+	err := syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode)
+	if err != nil {
+		return err
+	}
+	if on {
+		mode |= enableEchoInput
+	} else {
+		mode &^= enableEchoInput
+	}
+	r, _, err := procSetConsoleMode.Call(f.Fd(), uintptr(mode))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// consoleScreenBufferInfo is CONSOLE_SCREEN_BUFFER_INFO.
+type consoleScreenBufferInfo struct {
+	size, cursorPosition     [2]int16
+	attributes               uint16
+	left, top, right, bottom int16
+	maximumWindowSize        [2]int16
+}
+
+// terminalWidth returns the number of columns of the console f,
+// or 80 if it can't be found out.
+func terminalWidth(f *os.File) int {
+	var info consoleScreenBufferInfo
+	r, _, _ := procGetConsoleScreenBufferInfo.Call(f.Fd(), uintptr(unsafe.Pointer(&info)))
+	if r == 0 {
+		return 80
+	}
+	return int(info.right-info.left) + 1
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// Kinds of spans in OTLP.
+const (
+	spanKindInternal = 1
+	spanKindClient   = 3
+)
+
+// Tracer records spans of the listing, the transfers and their
+// requests and exports them to an OpenTelemetry collector with OTLP
+// over HTTP, so that slow transfers can be correlated with the
+// latency of requests in a tracing backend.
+type Tracer struct {
+	endpoint string
+	header   http.Header
+	client   *http.Client
+	traceID  string
+	// parentID is the span of the caller given in $TRACEPARENT,
+	// e.g. the CI job s3put runs in.
+	parentID string
+
+	mu sync.Mutex
+	// spans holds the ended spans, encoded for OTLP.
+	spans  []map[string]interface{}
+	failed bool
+	done   chan struct{}
+	closed chan struct{}
+}
+
+// Span is an operation of a trace.
+type Span struct {
+	tracer   *Tracer
+	id       string
+	parentID string
+	name     string
+	kind     int
+	start    time.Time
+	attrs    map[string]interface{}
+}
+
+type spanKey struct{}
+
+// NewTracer returns a tracer exporting to the collector at endpoint
+// (e.g. http://localhost:4318). Spans are exported in the background
+// every interval until Close is called. Headers for the collector can
+// be given in $OTEL_EXPORTER_OTLP_HEADERS (key=value,...).
+func NewTracer(endpoint string, interval time.Duration) (*Tracer, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("Invalid OTLP endpoint %s, must be an http or https URL", endpoint)
+	}
+	t := &Tracer{
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		header:   http.Header{},
+		// Exports must not show up in the traces
+		// and metrics, so they don't use the client
+		// of the storages.
+		client: &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+			Timeout:   10 * time.Second,
+		},
+		traceID: randomID(16),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if i := strings.Index(pair, "="); i > 0 {
+			t.header.Set(strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:]))
+		}
+	}
+	if traceID, parentID, ok := parseTraceparent(os.Getenv("TRACEPARENT")); ok {
+		t.traceID, t.parentID = traceID, parentID
+	}
+	go func() {
+		defer close(t.closed)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.export()
+			case <-t.done:
+				t.export()
+				return
+			}
+		}
+	}()
+	return t, nil
+}
+
+// parseTraceparent parses a W3C trace context header
+// like 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+func parseTraceparent(s string) (traceID, parentID string, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Start starts a span below the one in ctx (or the caller's, if there
+// is none) and returns a context carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	parentID := t.parentID
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		parentID = parent.id
+	}
+	s := &Span{
+		tracer:   t,
+		id:       randomID(8),
+		parentID: parentID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+		attrs:    map[string]interface{}{},
+	}
+	return s.Context(ctx), s
+}
+
+// Context returns a copy of ctx carrying s, so that
+// spans started with it are below s.
+func (s *Span) Context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SetAttr sets an attribute of the span to a string, int, int64 or bool.
+func (s *Span) SetAttr(key string, value interface{}) {
+	s.attrs[key] = value
+}
+
+// End ends the span, marking it as failed if err is not nil.
+func (s *Span) End(err error) {
+	span := map[string]interface{}{
+		"traceId":           s.tracer.traceID,
+		"spanId":            s.id,
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(time.Now().UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parentID != "" {
+		span["parentSpanId"] = s.parentID
+	}
+	if err != nil {
+		span["status"] = map[string]interface{}{"code": 2, "message": err.Error()}
+	}
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, span)
+	s.tracer.mu.Unlock()
+}
+
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	result := []interface{}{}
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case string:
+			v = map[string]interface{}{"stringValue": value}
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		result = append(result, map[string]interface{}{"key": key, "value": v})
+	}
+	return result
+}
+
+// export sends the ended spans to the collector.
+func (t *Tracer) export() {
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	err := t.post(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": "s3put"}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "s3put"},
+				"spans": spans,
+			}},
+		}},
+	})
+	// Only log the first error, the collector
+	// is likely to stay unreachable.
+	if err != nil && !t.failed {
+		t.failed = true
+		log.Printf("Could not export traces: %s", err)
+	}
+}
+
+func (t *Tracer) post(body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", t.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// Close exports the remaining spans.
+func (t *Tracer) Close() {
+	close(t.done)
+	<-t.closed
+}
+
+// TraceItems ends span when items is closed, so that it covers the
+// whole listing.
+func TraceItems(items <-chan *storage.Item, span *Span) <-chan *storage.Item {
+	c := make(chan *storage.Item)
+	go func() {
+		defer close(c)
+		n := 0
+		for item := range items {
+			n++
+			c <- item
+		}
+		span.SetAttr("s3put.files", n)
+		span.End(nil)
+	}()
+	return c
+}
+
+// TracingRoundTripper records a span for every request
+// made in the context of a span.
+type TracingRoundTripper struct {
+	http.RoundTripper
+}
+
+func (trt *TracingRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	parent, ok := r.Context().Value(spanKey{}).(*Span)
+	if !ok {
+		return trt.RoundTripper.RoundTrip(r)
+	}
+	_, span := parent.tracer.Start(r.Context(), r.Method, spanKindClient)
+	// Don't record signatures in the query of presigned requests.
+	u := *r.URL
+	u.RawQuery = ""
+	span.SetAttr("http.request.method", r.Method)
+	span.SetAttr("url.full", u.String())
+	resp, err := trt.RoundTripper.RoundTrip(r)
+	if err != nil {
+		span.End(err)
+		return nil, err
+	}
+	span.SetAttr("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		span.End(errors.New(resp.Status))
+	} else {
+		span.End(nil)
+	}
+	return resp, nil
+}
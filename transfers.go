@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/surma/s3put/storage"
+)
+
+// logTransfers enables logging the start and end of each transfer.
+var logTransfers = true
+
+// statsd receives the metrics of every transfer if it is set.
+var statsd *StatsD
+
+// tracer records a span for every transfer if it is set.
+var tracer *Tracer
+
+// hooks are run after the transfers if they are set.
+var hooks *Hooks
+
+// transferObserver logs, traces and reports the transfers
+// of CopyItems as configured on the command line.
+type transferObserver struct{}
+
+func (transferObserver) Begin(ctx context.Context, item *storage.Item) context.Context {
+	if tracer == nil {
+		return ctx
+	}
+	ctx, span := tracer.Start(ctx, "transfer", spanKindInternal)
+	span.SetAttr("s3put.key", item.Key())
+	span.SetAttr("s3put.size", item.Size)
+	return ctx
+}
+
+func (transferObserver) Copy(ctx context.Context, item *storage.Item) {
+	if logTransfers && !jsonLog {
+		infof("Transfering %s...", item)
+	}
+}
+
+func (transferObserver) End(ctx context.Context, item *storage.Item, skipped bool, err error, d time.Duration) {
+	if tracer != nil {
+		span := ctx.Value(spanKey{}).(*Span)
+		span.SetAttr("s3put.skipped", skipped)
+		span.End(err)
+	}
+	logTransfer(item, skipped, err, d)
+	if statsd != nil {
+		statsd.Transfer(item, skipped, err, d)
+	}
+	if hooks != nil {
+		hooks.Transfer(item, skipped, err, d)
+	}
+}